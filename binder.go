@@ -6,5 +6,11 @@ import (
 
 type Binder interface {
 	OnClientConnect(c io.Writer) error
-	OnClientDisconnect(c io.Writer)
+	OnClientDisconnect(c io.Writer, reason CloseReason)
+}
+
+// PongBinder is implemented by binders that want to see the pongs clients
+// send in reply to pings.
+type PongBinder interface {
+	OnPong(c io.Writer, r *Request)
 }
@@ -1,23 +1,50 @@
 package binders
 
 import (
+	"context"
+	"github.com/teltechsystems/teaspoon"
 	"io"
+	"sync"
 )
 
+// ConnectionPool keeps track of the connected clients. It is safe for
+// concurrent use.
 type ConnectionPool struct {
+	mu      sync.RWMutex
 	writers []io.Writer
 }
 
+// GetConnections returns a snapshot of the connected clients.
 func (p *ConnectionPool) GetConnections() []io.Writer {
-	return p.writers
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return append([]io.Writer(nil), p.writers...)
+}
+
+func (p *ConnectionPool) Len() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return len(p.writers)
 }
 
 func (p *ConnectionPool) OnClientConnect(w io.Writer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	p.writers = append(p.writers, w)
 	return nil
 }
 
-func (p *ConnectionPool) OnClientDisconnect(w io.Writer) {
+func (p *ConnectionPool) OnClientDisconnect(w io.Writer, reason teaspoon.CloseReason) {
+	p.remove(w)
+}
+
+func (p *ConnectionPool) remove(w io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	index := -1
 
 	for i := 0; i < len(p.writers); i++ {
@@ -31,3 +58,44 @@ func (p *ConnectionPool) OnClientDisconnect(w io.Writer) {
 		p.writers = append(p.writers[0:index], p.writers[index+1:len(p.writers)]...)
 	}
 }
+
+// Broadcast sends req to every connection and returns how many it reached.
+func (p *ConnectionPool) Broadcast(req *teaspoon.Request) int {
+	return p.BroadcastFunc(nil, req)
+}
+
+// BroadcastFunc sends req to the connections for which filter returns true,
+// or to all of them if filter is nil, and returns how many it reached.
+// Connections that fail to accept the request are removed from the pool.
+func (p *ConnectionPool) BroadcastFunc(filter func(io.Writer) bool, req *teaspoon.Request) int {
+	if req.RequestID == (teaspoon.RequestID{}) {
+		req.RequestID = teaspoon.NewRequestID()
+	}
+
+	sent := 0
+
+	for _, w := range p.GetConnections() {
+		if filter != nil && !filter(w) {
+			continue
+		}
+
+		if err := send(w, req); err != nil {
+			p.remove(w)
+			continue
+		}
+
+		sent++
+	}
+
+	return sent
+}
+
+func send(w io.Writer, req *teaspoon.Request) error {
+	if conn, ok := w.(teaspoon.Conn); ok {
+		return conn.Push(context.Background(), req)
+	}
+
+	_, err := req.WriteTo(w)
+
+	return err
+}
@@ -0,0 +1,81 @@
+package binders
+
+import (
+	"bytes"
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/teltechsystems/teaspoon"
+	"io"
+	"sync"
+	"testing"
+)
+
+type failingWriter struct{}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestConnectionPoolConcurrency(t *testing.T) {
+	Convey("Connections should be tracked safely from concurrent goroutines", t, func() {
+		pool := &ConnectionPool{}
+		wg := sync.WaitGroup{}
+
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				b := bytes.NewBuffer([]byte{})
+				pool.OnClientConnect(b)
+				pool.GetConnections()
+				pool.OnClientDisconnect(b, teaspoon.CloseReason{})
+			}()
+		}
+
+		wg.Wait()
+		So(pool.Len(), ShouldEqual, 0)
+	})
+}
+
+func TestConnectionPoolBroadcast(t *testing.T) {
+	Convey("A broadcast should reach every connection and drop the dead ones", t, func() {
+		pool := &ConnectionPool{}
+
+		first := bytes.NewBuffer([]byte{})
+		second := bytes.NewBuffer([]byte{})
+		broken := &failingWriter{}
+
+		pool.OnClientConnect(first)
+		pool.OnClientConnect(broken)
+		pool.OnClientConnect(second)
+
+		req := &teaspoon.Request{OpCode: teaspoon.OPCODE_BINARY, Payload: []byte("HELLO")}
+		So(pool.Broadcast(req), ShouldEqual, 2)
+		So(req.RequestID, ShouldNotResemble, teaspoon.RequestID{})
+
+		for _, b := range []*bytes.Buffer{first, second} {
+			received, err := teaspoon.NewDecoder(b).Decode()
+			So(err, ShouldBeNil)
+			So(received.RequestID, ShouldResemble, req.RequestID)
+			So(received.Payload, ShouldResemble, []byte("HELLO"))
+		}
+
+		So(pool.Len(), ShouldEqual, 2)
+		So(pool.GetConnections(), ShouldResemble, []io.Writer{first, second})
+	})
+
+	Convey("BroadcastFunc should only reach the connections matching the filter", t, func() {
+		pool := &ConnectionPool{}
+
+		first := bytes.NewBuffer([]byte{})
+		second := bytes.NewBuffer([]byte{})
+		pool.OnClientConnect(first)
+		pool.OnClientConnect(second)
+
+		sent := pool.BroadcastFunc(func(w io.Writer) bool { return w == second }, &teaspoon.Request{OpCode: teaspoon.OPCODE_BINARY})
+		So(sent, ShouldEqual, 1)
+		So(first.Len(), ShouldEqual, 0)
+		So(second.Len(), ShouldBeGreaterThan, 0)
+	})
+}
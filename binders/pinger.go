@@ -4,28 +4,156 @@ import (
 	"github.com/teltechsystems/teaspoon"
 	"io"
 	"math/rand"
+	"sync"
 	"time"
 )
 
+// DefaultMaxMissedPongs is used when Pinger.MaxMissedPongs is zero.
+const DefaultMaxMissedPongs = 3
+
+// Clock is the source of time for a Pinger.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Pinger pings every connection once per interval. Each connection is
+// pinged at a random offset into the interval, so pings are spread out
+// rather than sent to all connections at once.
 type Pinger struct {
 	ConnectionPool
 	interval time.Duration
+	clock    Clock
+
+	// MaxMissedPongs is the number of consecutive pings a connection may
+	// leave unanswered before it is closed.
+	MaxMissedPongs int
+
+	// PongTimeout is how long a ping may go unanswered before it counts as
+	// missed. A pong arriving later still measures the round trip. Zero
+	// means the ping interval.
+	PongTimeout time.Duration
+
+	mu     sync.Mutex
+	states map[io.Writer]*pingState
+	jitter *rand.Rand
+
+	wake     chan bool
+	stop     chan bool
+	stopOnce sync.Once
+	done     chan bool
+}
+
+type pingState struct {
+	next        time.Time
+	outstanding map[teaspoon.RequestID]time.Time
+	rtt         time.Duration
+	measured    bool
 }
 
 func (p *Pinger) processPings() {
-	intervalInt := int64(p.interval / time.Second)
+	defer close(p.done)
 
 	for {
-		for i := 0; i < int(intervalInt); i++ {
-			connections := p.GetConnections()
-			for j := i; j < len(connections); j += int(intervalInt) {
-				if p.writers[j] != nil {
-					p.sendPing(connections[j])
-				}
+		due, wait := p.duePings(p.clock.Now())
+		for _, w := range due {
+			p.sendPing(w)
+		}
+
+		var timer <-chan time.Time
+		if wait >= 0 {
+			timer = p.clock.After(wait)
+		}
+
+		select {
+		case <-p.stop:
+			return
+		case <-p.wake:
+		case <-timer:
+		}
+	}
+}
+
+// duePings returns the connections to ping at now and how long to wait for
+// the next one, which is negative if there are no connections to ping.
+func (p *Pinger) duePings(now time.Time) ([]io.Writer, time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	due := []io.Writer{}
+	wait := time.Duration(-1)
+
+	for w, state := range p.states {
+		if state.next.IsZero() {
+			continue
+		}
+
+		if !state.next.After(now) {
+			due = append(due, w)
+
+			state.next = state.next.Add(p.interval)
+			if !state.next.After(now) {
+				state.next = now.Add(p.interval)
 			}
-			time.Sleep(time.Second)
 		}
+
+		if until := state.next.Sub(now); wait < 0 || until < wait {
+			wait = until
+		}
+	}
+
+	return due, wait
+}
+
+func (p *Pinger) state(w io.Writer) *pingState {
+	if p.states == nil {
+		p.states = make(map[io.Writer]*pingState)
+	}
+
+	state := p.states[w]
+	if state == nil {
+		state = &pingState{outstanding: make(map[teaspoon.RequestID]time.Time)}
+		p.states[w] = state
+	}
+
+	return state
+}
+
+func (p *Pinger) OnClientConnect(w io.Writer) error {
+	p.ConnectionPool.OnClientConnect(w)
+
+	if p.interval <= 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	offset := time.Duration(p.jitter.Int63n(int64(p.interval)))
+	p.state(w).next = p.clock.Now().Add(offset)
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- true:
+	default:
 	}
+
+	return nil
+}
+
+// Stop stops sending pings. Connections are left open.
+func (p *Pinger) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
 }
 
 func (p *Pinger) sendPing(w io.Writer) {
@@ -34,6 +162,11 @@ func (p *Pinger) sendPing(w io.Writer) {
 		requestID[i] = byte(rand.Intn(16))
 	}
 
+	if !p.trackPing(w, requestID, p.clock.Now()) {
+		p.evict(w)
+		return
+	}
+
 	r := &teaspoon.Request{
 		OpCode:    teaspoon.OPCODE_PING,
 		Priority:  5,
@@ -46,8 +179,132 @@ func (p *Pinger) sendPing(w io.Writer) {
 	r.WriteTo(w)
 }
 
+// trackPing records a ping about to be sent to w. Pings unanswered for
+// longer than PongTimeout count as missed, and false is returned once w has
+// missed too many.
+func (p *Pinger) trackPing(w io.Writer, requestID teaspoon.RequestID, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state := p.state(w)
+
+	timeout := p.PongTimeout
+	if timeout <= 0 {
+		timeout = p.interval
+	}
+
+	missed := 0
+	for _, sent := range state.outstanding {
+		if !sent.Add(timeout).After(now) {
+			missed++
+		}
+	}
+
+	maxMissed := p.MaxMissedPongs
+	if maxMissed <= 0 {
+		maxMissed = DefaultMaxMissedPongs
+	}
+
+	if missed >= maxMissed {
+		return false
+	}
+
+	state.outstanding[requestID] = now
+
+	return true
+}
+
+// evict closes a connection that stopped answering pings.
+func (p *Pinger) evict(w io.Writer) {
+	p.forget(w)
+	p.remove(w)
+
+	if closer, ok := w.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+func (p *Pinger) forget(w io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.states, w)
+}
+
+// OnPong measures the round trip of the ping r answers. Pings sent before it
+// are no longer waited for.
+func (p *Pinger) OnPong(w io.Writer, r *teaspoon.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state := p.states[w]
+	if state == nil {
+		return
+	}
+
+	sent, ok := state.outstanding[r.RequestID]
+	if !ok {
+		return
+	}
+
+	for requestID, at := range state.outstanding {
+		if !at.After(sent) {
+			delete(state.outstanding, requestID)
+		}
+	}
+
+	state.rtt = p.clock.Now().Sub(sent)
+	state.measured = true
+}
+
+func (p *Pinger) OnClientDisconnect(w io.Writer, reason teaspoon.CloseReason) {
+	p.forget(w)
+	p.ConnectionPool.OnClientDisconnect(w, reason)
+}
+
+// RTT returns the round trip time of the last ping w answered.
+func (p *Pinger) RTT(w io.Writer) (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if state := p.states[w]; state != nil && state.measured {
+		return state.rtt, true
+	}
+
+	return 0, false
+}
+
+// RTTs returns the round trip time of every connection that has answered a
+// ping.
+func (p *Pinger) RTTs() map[io.Writer]time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rtts := make(map[io.Writer]time.Duration)
+	for w, state := range p.states {
+		if state.measured {
+			rtts[w] = state.rtt
+		}
+	}
+
+	return rtts
+}
+
 func NewPinger(interval time.Duration) *Pinger {
-	pinger := &Pinger{interval: interval}
+	return NewPingerWithClock(interval, realClock{}, rand.NewSource(time.Now().UnixNano()))
+}
+
+// NewPingerWithClock creates a Pinger that takes the time from clock and
+// the offsets connections are pinged at from jitter.
+func NewPingerWithClock(interval time.Duration, clock Clock, jitter rand.Source) *Pinger {
+	pinger := &Pinger{
+		interval: interval,
+		clock:    clock,
+		jitter:   rand.New(jitter),
+		wake:     make(chan bool, 1),
+		stop:     make(chan bool),
+		done:     make(chan bool),
+	}
 
 	go pinger.processPings()
 
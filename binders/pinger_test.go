@@ -2,14 +2,94 @@ package binders
 
 import (
 	"bytes"
+	"fmt"
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/teltechsystems/teaspoon"
 	"io"
 	"math/rand"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 )
 
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	timer := fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, timer)
+
+	return timer.c
+}
+
+// Advance moves the clock forward once a timer is waiting, firing the timers
+// that are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	for {
+		c.mu.Lock()
+		if len(c.timers) > 0 {
+			break
+		}
+		c.mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+	}
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+
+	pending := []fakeTimer{}
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+			continue
+		}
+
+		timer.c <- c.now
+	}
+	c.timers = pending
+}
+
+// pingRecorder reports every ping written to it, along with the time it
+// was sent if it has a clock.
+type pingRecorder struct {
+	name  string
+	pings chan string
+	clock Clock
+}
+
+func (r *pingRecorder) Write(p []byte) (int, error) {
+	if r.clock != nil {
+		r.pings <- fmt.Sprintf("%s at %s", r.name, r.clock.Now().Sub(time.Unix(0, 0)))
+	} else {
+		r.pings <- r.name
+	}
+	return len(p), nil
+}
+
 type dummyRwc struct {
 	io.ReadWriter
 }
@@ -25,6 +105,7 @@ func newDummyRwc(rw io.ReadWriter) io.ReadWriteCloser {
 func TestNewPinger(t *testing.T) {
 	Convey("A basic pinger should set up a few known properties", t, func() {
 		pinger := NewPinger(time.Second * 1)
+		defer pinger.Stop()
 		So(pinger.interval, ShouldEqual, time.Second*1)
 		So(len(pinger.writers), ShouldEqual, 0)
 
@@ -37,7 +118,7 @@ func TestNewPinger(t *testing.T) {
 		So(len(pinger.writers), ShouldEqual, 1)
 		So(pinger.writers[0], ShouldEqual, b)
 
-		pinger.OnClientDisconnect(b)
+		pinger.OnClientDisconnect(b, teaspoon.CloseReason{})
 		So(len(pinger.writers), ShouldEqual, 0)
 	})
 }
@@ -45,7 +126,8 @@ func TestNewPinger(t *testing.T) {
 func TestPingerSendPing(t *testing.T) {
 	Convey("With a valid pinger delivering static pings", t, func() {
 		rand.Seed(0)
-		pinger := NewPinger(time.Second * 1000)
+		pinger := NewPingerWithClock(time.Second*1000, newFakeClock(), rand.NewSource(0))
+		defer pinger.Stop()
 
 		b := bytes.NewBuffer([]byte{})
 		pinger.OnClientConnect(b)
@@ -56,18 +138,165 @@ func TestPingerSendPing(t *testing.T) {
 }
 
 func TestPingerProcessPings(t *testing.T) {
-	Convey("With the pingProcessor running at known intervals", t, func() {
-		rand.Seed(0)
-		pinger := NewPinger(time.Second * 1)
+	Convey("Every connection should be pinged once per interval", t, func() {
+		clock := newFakeClock()
+		pinger := NewPingerWithClock(time.Millisecond*100, clock, rand.NewSource(0))
+		defer pinger.Stop()
 
-		b := bytes.NewBuffer([]byte{})
+		pings := make(chan string, 10)
+		for _, name := range []string{"A", "B", "C"} {
+			pinger.OnClientConnect(&pingRecorder{name: name, pings: pings})
+		}
+
+		for round := 0; round < 3; round++ {
+			clock.Advance(time.Millisecond * 100)
+
+			pinged := map[string]int{}
+			for i := 0; i < 3; i++ {
+				pinged[<-pings]++
+			}
+			So(pinged, ShouldResemble, map[string]int{"A": 1, "B": 1, "C": 1})
+		}
+	})
+
+	Convey("Each connection should first be pinged at its random offset into the interval", t, func() {
+		clock := newFakeClock()
+		pinger := NewPingerWithClock(time.Second, clock, rand.NewSource(1))
+		defer pinger.Stop()
+
+		jitter := rand.New(rand.NewSource(1))
+		names := []string{"A", "B", "C"}
+		offsets := map[string]time.Duration{}
+		pings := make(chan string, len(names))
+		for _, name := range names {
+			offsets[name] = time.Duration(jitter.Int63n(int64(time.Second)))
+			pinger.OnClientConnect(&pingRecorder{name: name, pings: pings, clock: clock})
+		}
+
+		sort.Slice(names, func(i, j int) bool { return offsets[names[i]] < offsets[names[j]] })
+
+		elapsed := time.Duration(0)
+		for _, name := range names {
+			clock.Advance(offsets[name] - elapsed)
+			elapsed = offsets[name]
+
+			So(<-pings, ShouldEqual, fmt.Sprintf("%s at %s", name, offsets[name]))
+		}
+	})
+
+	Convey("A stopped pinger should stop its goroutine", t, func() {
+		pinger := NewPingerWithClock(time.Millisecond, newFakeClock(), rand.NewSource(0))
+		pinger.Stop()
+		pinger.Stop()
+
+		select {
+		case <-pinger.done:
+		case <-time.After(time.Second):
+			So("the pinger did not stop", ShouldBeEmpty)
+		}
+	})
+}
+
+type closableBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *closableBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestPingerPongs(t *testing.T) {
+	Convey("A pong should be matched to its ping and measure the round trip", t, func() {
+		clock := newFakeClock()
+		pinger := NewPingerWithClock(0, clock, rand.NewSource(0))
+		defer pinger.Stop()
+
+		_, matchesInterface := interface{}(pinger).(teaspoon.PongBinder)
+		So(matchesInterface, ShouldBeTrue)
+
+		b := &closableBuffer{}
 		pinger.OnClientConnect(b)
-		time.Sleep(time.Second * 1)
 
-		So(b.Bytes(), ShouldResemble, []byte{149, 0, 0, 0, 0, 0, 0, 1, 10, 2, 9, 10, 11, 0, 15, 5, 8, 0, 8, 11, 11, 12, 8, 14, 0, 0, 0, 0})
+		_, ok := pinger.RTT(b)
+		So(ok, ShouldBeFalse)
+
+		pinger.sendPing(b)
+		ping, err := teaspoon.NewDecoder(b).Decode()
+		So(err, ShouldBeNil)
+
+		clock.mu.Lock()
+		clock.now = clock.now.Add(time.Millisecond * 5)
+		clock.mu.Unlock()
+
+		pinger.OnPong(b, &teaspoon.Request{OpCode: teaspoon.OPCODE_PONG, RequestID: ping.RequestID})
+
+		rtt, ok := pinger.RTT(b)
+		So(ok, ShouldBeTrue)
+		So(rtt, ShouldEqual, time.Millisecond*5)
+		So(pinger.RTTs(), ShouldResemble, map[io.Writer]time.Duration{b: rtt})
+	})
+
+	Convey("A pong arriving after the next ping was sent should still be matched", t, func() {
+		clock := newFakeClock()
+		pinger := NewPingerWithClock(0, clock, rand.NewSource(0))
+		pinger.MaxMissedPongs = 1
+		pinger.PongTimeout = time.Millisecond * 20
+		defer pinger.Stop()
+
+		b := &closableBuffer{}
+		pinger.OnClientConnect(b)
+
+		pinger.sendPing(b)
+		ping, err := teaspoon.NewDecoder(b).Decode()
+		So(err, ShouldBeNil)
+
+		clock.mu.Lock()
+		clock.now = clock.now.Add(time.Millisecond * 10)
+		clock.mu.Unlock()
+
+		pinger.sendPing(b)
+		So(b.closed, ShouldBeFalse)
+
+		clock.mu.Lock()
+		clock.now = clock.now.Add(time.Millisecond * 5)
+		clock.mu.Unlock()
+
+		pinger.OnPong(b, &teaspoon.Request{OpCode: teaspoon.OPCODE_PONG, RequestID: ping.RequestID})
+
+		rtt, ok := pinger.RTT(b)
+		So(ok, ShouldBeTrue)
+		So(rtt, ShouldEqual, time.Millisecond*15)
+	})
+
+	Convey("A connection missing consecutive pongs should be closed and removed", t, func() {
+		pinger := NewPingerWithClock(0, newFakeClock(), rand.NewSource(0))
+		pinger.MaxMissedPongs = 2
+		defer pinger.Stop()
+
+		b := &closableBuffer{}
+		pinger.OnClientConnect(b)
+
+		pinger.sendPing(b)
 		b.Reset()
+		pinger.sendPing(b)
+		So(b.closed, ShouldBeFalse)
+
+		// Answering a ping resets the count of missed ones.
+		ping, err := teaspoon.NewDecoder(b).Decode()
+		So(err, ShouldBeNil)
+		pinger.OnPong(b, &teaspoon.Request{OpCode: teaspoon.OPCODE_PONG, RequestID: ping.RequestID})
+
+		pinger.sendPing(b)
+		pinger.sendPing(b)
+		So(b.closed, ShouldBeFalse)
+
+		pinger.sendPing(b)
+		So(b.closed, ShouldBeTrue)
+		So(pinger.Len(), ShouldEqual, 0)
 
-		time.Sleep(time.Second * 1)
-		So(b.Bytes(), ShouldResemble, []byte{149, 0, 0, 0, 0, 0, 0, 1, 15, 2, 2, 14, 11, 4, 10, 12, 1, 10, 0, 0, 15, 12, 13, 4, 0, 0, 0, 0})
+		_, ok := pinger.RTT(b)
+		So(ok, ShouldBeFalse)
 	})
 }
@@ -0,0 +1,150 @@
+package binders
+
+import (
+	"github.com/teltechsystems/teaspoon"
+	"io"
+	"strings"
+	"sync"
+)
+
+// PubSub delivers published messages to the connections subscribed to their
+// topic. Topics are made of segments separated by dots. In a subscription,
+// "*" matches exactly one segment and "#" matches any number of trailing
+// segments, so "chat.*" receives "chat.lobby" and "chat.#" receives
+// "chat.lobby.bob" as well. Subscriptions are removed when their connection
+// disconnects. PubSub is safe for concurrent use.
+type PubSub struct {
+	mu            sync.RWMutex
+	subscribers   map[string]map[io.Writer]bool
+	subscriptions map[io.Writer]map[string]bool
+}
+
+func NewPubSub() *PubSub {
+	return &PubSub{
+		subscribers:   make(map[string]map[io.Writer]bool),
+		subscriptions: make(map[io.Writer]map[string]bool),
+	}
+}
+
+func (ps *PubSub) OnClientConnect(w io.Writer) error {
+	return nil
+}
+
+func (ps *PubSub) OnClientDisconnect(w io.Writer, reason teaspoon.CloseReason) {
+	ps.unsubscribeAll(w)
+}
+
+func (ps *PubSub) Subscribe(w io.Writer, topic string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.subscribers[topic] == nil {
+		ps.subscribers[topic] = make(map[io.Writer]bool)
+	}
+	ps.subscribers[topic][w] = true
+
+	if ps.subscriptions[w] == nil {
+		ps.subscriptions[w] = make(map[string]bool)
+	}
+	ps.subscriptions[w][topic] = true
+}
+
+func (ps *PubSub) Unsubscribe(w io.Writer, topic string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.unsubscribe(w, topic)
+}
+
+func (ps *PubSub) unsubscribe(w io.Writer, topic string) {
+	delete(ps.subscribers[topic], w)
+	if len(ps.subscribers[topic]) == 0 {
+		delete(ps.subscribers, topic)
+	}
+
+	delete(ps.subscriptions[w], topic)
+	if len(ps.subscriptions[w]) == 0 {
+		delete(ps.subscriptions, w)
+	}
+}
+
+func (ps *PubSub) unsubscribeAll(w io.Writer) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for topic := range ps.subscriptions[w] {
+		ps.unsubscribe(w, topic)
+	}
+}
+
+// Subscribers returns the connections a message published to topic reaches.
+func (ps *PubSub) Subscribers(topic string) []io.Writer {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	seen := map[io.Writer]bool{}
+	writers := []io.Writer{}
+
+	for pattern, subscribers := range ps.subscribers {
+		if !matchTopic(pattern, topic) {
+			continue
+		}
+
+		for w := range subscribers {
+			if !seen[w] {
+				seen[w] = true
+				writers = append(writers, w)
+			}
+		}
+	}
+
+	return writers
+}
+
+// Publish sends payload as a binary message to the subscribers of topic and
+// returns how many it reached.
+func (ps *PubSub) Publish(topic string, payload []byte) int {
+	return ps.PublishRequest(topic, &teaspoon.Request{OpCode: teaspoon.OPCODE_BINARY, Payload: payload})
+}
+
+// PublishRequest sends req to the subscribers of topic and returns how many
+// it reached. Connections that fail to accept it lose their subscriptions.
+func (ps *PubSub) PublishRequest(topic string, req *teaspoon.Request) int {
+	if req.RequestID == (teaspoon.RequestID{}) {
+		req.RequestID = teaspoon.NewRequestID()
+	}
+
+	sent := 0
+
+	for _, w := range ps.Subscribers(topic) {
+		if err := send(w, req); err != nil {
+			ps.unsubscribeAll(w)
+			continue
+		}
+
+		sent++
+	}
+
+	return sent
+}
+
+func matchTopic(pattern string, topic string) bool {
+	patternSegments := strings.Split(pattern, ".")
+	topicSegments := strings.Split(topic, ".")
+
+	for i, segment := range patternSegments {
+		if segment == "#" {
+			return true
+		}
+
+		if i >= len(topicSegments) {
+			return false
+		}
+
+		if segment != "*" && segment != topicSegments[i] {
+			return false
+		}
+	}
+
+	return len(patternSegments) == len(topicSegments)
+}
@@ -0,0 +1,73 @@
+package binders
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/teltechsystems/teaspoon"
+	"io"
+	"testing"
+)
+
+func TestMatchTopic(t *testing.T) {
+	Convey("Topics should match exact and wildcard subscriptions", t, func() {
+		So(matchTopic("chat.lobby", "chat.lobby"), ShouldBeTrue)
+		So(matchTopic("chat.lobby", "chat.games"), ShouldBeFalse)
+		So(matchTopic("chat.*", "chat.lobby"), ShouldBeTrue)
+		So(matchTopic("chat.*", "chat.lobby.bob"), ShouldBeFalse)
+		So(matchTopic("chat.#", "chat.lobby.bob"), ShouldBeTrue)
+		So(matchTopic("chat.#", "chat"), ShouldBeTrue)
+		So(matchTopic("*.lobby", "chat.lobby"), ShouldBeTrue)
+		So(matchTopic("chat.lobby.bob", "chat.lobby"), ShouldBeFalse)
+	})
+}
+
+func TestPubSub(t *testing.T) {
+	Convey("Published messages should reach each matching subscriber once", t, func() {
+		ps := NewPubSub()
+
+		_, matchesInterface := interface{}(ps).(teaspoon.Binder)
+		So(matchesInterface, ShouldBeTrue)
+
+		alice := bytes.NewBuffer([]byte{})
+		bob := bytes.NewBuffer([]byte{})
+
+		ps.Subscribe(alice, "chat.lobby")
+		ps.Subscribe(alice, "chat.*")
+		ps.Subscribe(bob, "news")
+
+		So(ps.Publish("chat.lobby", []byte("HELLO")), ShouldEqual, 1)
+
+		received, err := teaspoon.NewDecoder(alice).Decode()
+		So(err, ShouldBeNil)
+		So(received.Payload, ShouldResemble, []byte("HELLO"))
+		So(alice.Len(), ShouldEqual, 0)
+		So(bob.Len(), ShouldEqual, 0)
+	})
+
+	Convey("Subscriptions should be removed on unsubscribe and disconnect", t, func() {
+		ps := NewPubSub()
+
+		alice := bytes.NewBuffer([]byte{})
+		bob := bytes.NewBuffer([]byte{})
+
+		ps.Subscribe(alice, "news")
+		ps.Subscribe(bob, "news")
+		ps.Subscribe(bob, "chat.#")
+
+		ps.Unsubscribe(alice, "news")
+		So(ps.Subscribers("news"), ShouldResemble, []io.Writer{bob})
+
+		ps.OnClientDisconnect(bob, teaspoon.CloseReason{})
+		So(ps.Publish("news", []byte("HELLO")), ShouldEqual, 0)
+		So(len(ps.subscribers), ShouldEqual, 0)
+		So(len(ps.subscriptions), ShouldEqual, 0)
+	})
+
+	Convey("Subscribers whose connection fails should be dropped", t, func() {
+		ps := NewPubSub()
+
+		ps.Subscribe(&failingWriter{}, "news")
+		So(ps.Publish("news", []byte("HELLO")), ShouldEqual, 0)
+		So(len(ps.subscriptions), ShouldEqual, 0)
+	})
+}
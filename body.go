@@ -0,0 +1,134 @@
+package teaspoon
+
+import (
+	"io"
+	"sync"
+)
+
+// requestBody is the Body of a streamed request. The connection's reader
+// pushes the payload of every frame as it arrives. Until the handler starts
+// the frames are buffered, since a queued handler cannot take them; after
+// that the reader blocks once bodyFrames frames are waiting, so a slow
+// handler holds back the connection instead of buffering the whole request.
+type requestBody struct {
+	mu       sync.Mutex
+	frames   [][]byte
+	started  bool
+	finished bool
+	err      error
+	buf      []byte
+
+	// ready is signalled when frames are added or the body is finished, and
+	// space when the handler takes a frame.
+	ready chan bool
+	space chan bool
+
+	closed    chan bool
+	closeOnce sync.Once
+}
+
+const bodyFrames = 4
+
+func newRequestBody() *requestBody {
+	return &requestBody{
+		ready:  make(chan bool, 1),
+		space:  make(chan bool, 1),
+		closed: make(chan bool),
+	}
+}
+
+// start is called once the handler runs, after which push waits for it to
+// take the frames.
+func (b *requestBody) start() {
+	b.mu.Lock()
+	b.started = true
+	b.mu.Unlock()
+}
+
+// push hands payload to the handler. It gives up once the handler closed the
+// body or quit is closed.
+func (b *requestBody) push(payload []byte, quit <-chan bool) {
+	for {
+		b.mu.Lock()
+		if !b.started || len(b.frames) < bodyFrames {
+			b.frames = append(b.frames, payload)
+			b.mu.Unlock()
+			signal(b.ready)
+			return
+		}
+		b.mu.Unlock()
+
+		select {
+		case <-b.space:
+		case <-b.closed:
+			return
+		case <-quit:
+			return
+		}
+	}
+}
+
+// isClosed reports whether the handler has closed the body.
+func (b *requestBody) isClosed() bool {
+	select {
+	case <-b.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// finish ends the body. Reads fail with err once the pushed frames are
+// consumed, or with io.EOF if err is nil.
+func (b *requestBody) finish(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+
+	b.mu.Lock()
+	b.err = err
+	b.finished = true
+	b.mu.Unlock()
+
+	signal(b.ready)
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 {
+		b.mu.Lock()
+		if len(b.frames) > 0 {
+			b.buf = b.frames[0]
+			b.frames = b.frames[1:]
+			b.mu.Unlock()
+			signal(b.space)
+			continue
+		}
+
+		finished, err := b.finished, b.err
+		b.mu.Unlock()
+
+		if finished {
+			return 0, err
+		}
+
+		<-b.ready
+	}
+
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+
+	return n, nil
+}
+
+// Close discards the remainder of the request.
+func (b *requestBody) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.closed)
+	})
+
+	b.mu.Lock()
+	b.frames = nil
+	b.mu.Unlock()
+
+	return nil
+}
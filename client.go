@@ -0,0 +1,450 @@
+package teaspoon
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const closeTimeout = time.Second
+
+var (
+	ClientClosed       = errors.New("The client connection has been closed")
+	DuplicateRequestID = errors.New("A request with the same request ID is already in flight")
+	CallCanceled       = errors.New("The call was canceled before a reply arrived")
+	ConnectionLost     = errors.New("The connection to the server was lost")
+	ServerUnresponsive = errors.New("The server stopped answering keepalive pings")
+)
+
+// Call represents an in-flight request started with Client.Go.
+type Call struct {
+	Request *Request
+	Reply   *Request
+	Error   error
+	Done    chan *Call
+	client  *Client
+}
+
+func (call *Call) done() {
+	select {
+	case call.Done <- call:
+	default:
+		logger.Println("Client: discarding call reply due to insufficient Done chan capacity")
+	}
+}
+
+// Cancel abandons the call, freeing its RequestID. A reply that arrives
+// afterwards is discarded. Cancelling a completed call has no effect.
+func (call *Call) Cancel() {
+	if call.client.remove(call.Request.RequestID, call) {
+		call.Error = CallCanceled
+		call.done()
+	}
+}
+
+// Client multiplexes requests over a single connection. Replies are matched
+// to their callers by RequestID, so a Client may be shared by any number of
+// goroutines.
+type Client struct {
+	rwc     io.ReadWriteCloser
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	pending map[RequestID]*Call
+	closing bool
+	err     error
+	done    chan bool
+
+	// draining is set once a close frame has been sent or received; no new
+	// calls are accepted afterwards.
+	draining  bool
+	closeSent bool
+	peerClose *CloseReason
+
+	maxFrameSize    int
+	maxRequestBytes int64
+	pushHandler     func(*Request)
+	session         *SessionID
+
+	keepAliveInterval time.Duration
+	keepAliveTimeout  time.Duration
+	unresponsive      bool
+
+	reconnect *ReconnectPolicy
+	dial      func() (io.ReadWriteCloser, error)
+	quit      chan bool
+}
+
+// ClientOption configures a Client created by Dial or NewClient.
+type ClientOption func(*Client)
+
+// WithMaxFrameSize sets the size requests are split into and the largest
+// frame accepted from the server. The default is DefaultMaxFrameSize.
+func WithMaxFrameSize(size int) ClientOption {
+	return func(c *Client) {
+		c.maxFrameSize = size
+	}
+}
+
+// WithMaxRequestBytes limits the total payload of a reply. A server sending
+// a larger reply is disconnected with CLOSE_TOO_LARGE.
+func WithMaxRequestBytes(n int64) ClientOption {
+	return func(c *Client) {
+		c.maxRequestBytes = n
+	}
+}
+
+// WithPushHandler sets the function called with messages the server pushes
+// to the client, which the server marks with FLAG_PUSH. It runs on the
+// goroutine reading replies, so it must not block. Pushes asking for an
+// acknowledgement are acknowledged once it returns; without a handler they
+// are discarded unacknowledged.
+func WithPushHandler(handler func(*Request)) ClientOption {
+	return func(c *Client) {
+		c.pushHandler = handler
+	}
+}
+
+// WithSession announces id to the server when the client connects. Pushes
+// the server sent WithAck that were not acknowledged before a disconnect are
+// sent again to a client resuming the same session.
+func WithSession(id SessionID) ClientOption {
+	return func(c *Client) {
+		c.session = &id
+	}
+}
+
+func Dial(addr string, opts ...ClientOption) (*Client, error) {
+	rwc, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := func(c *Client) {
+		c.dial = func() (io.ReadWriteCloser, error) {
+			return net.Dial("tcp", addr)
+		}
+	}
+
+	return NewClient(rwc, append([]ClientOption{dialer}, opts...)...), nil
+}
+
+func NewClient(rwc io.ReadWriteCloser, opts ...ClientOption) *Client {
+	c := &Client{
+		rwc:          rwc,
+		pending:      make(map[RequestID]*Call),
+		done:         make(chan bool),
+		quit:         make(chan bool),
+		maxFrameSize: DefaultMaxFrameSize,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.reconnect != nil && c.reconnect.Dial != nil {
+		c.dial = c.reconnect.Dial
+	}
+
+	go c.readReplies()
+
+	c.announceSession()
+
+	if c.keepAliveInterval > 0 {
+		go c.keepAlive()
+	}
+
+	return c
+}
+
+func (c *Client) announceSession() {
+	if c.session != nil {
+		c.send(&Request{OpCode: OPCODE_SESSION, RequestID: NewRequestID(), Payload: c.session[:]})
+	}
+}
+
+func (c *Client) register(call *Call) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return c.err
+	}
+
+	if c.draining {
+		return ClientClosed
+	}
+
+	req := call.Request
+	if req.RequestID == (RequestID{}) {
+		for {
+			req.RequestID = NewRequestID()
+			if _, ok := c.pending[req.RequestID]; !ok {
+				break
+			}
+		}
+	} else if _, ok := c.pending[req.RequestID]; ok {
+		return DuplicateRequestID
+	}
+
+	c.pending[req.RequestID] = call
+
+	return nil
+}
+
+// remove deletes the pending entry for requestID if it still belongs to call,
+// reporting whether it did. Whoever removes a call is responsible for
+// completing it.
+func (c *Client) remove(requestID RequestID, call *Call) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pending[requestID] != call {
+		return false
+	}
+
+	delete(c.pending, requestID)
+
+	return true
+}
+
+// send writes req to the connection. A failed write leaves the stream
+// unusable, so the connection is closed and the reader takes care of the
+// pending calls.
+func (c *Client) send(req *Request) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	_, err := req.writeFrames(c.rwc, c.maxFrameSize)
+	if err != nil && err != RequestPayloadLengthExceeded {
+		c.rwc.Close()
+	}
+
+	return err
+}
+
+// Go sends req without waiting for the reply. The returned Call is delivered
+// on done once it completes; if done is nil a new buffered channel is
+// allocated. A zero RequestID is replaced with a generated one.
+func (c *Client) Go(req *Request, done chan *Call) *Call {
+	if done == nil {
+		done = make(chan *Call, 10)
+	} else if cap(done) == 0 {
+		panic("teaspoon: done channel is unbuffered")
+	}
+
+	outgoing := *req
+	call := &Call{Request: &outgoing, Done: done, client: c}
+
+	if err := c.register(call); err != nil {
+		call.Error = err
+		call.done()
+		return call
+	}
+
+	if err := c.send(call.Request); err != nil {
+		switch {
+		case err == RequestPayloadLengthExceeded:
+		case c.reconnect == nil || c.reconnect.RetryPending:
+			// The reader fails the call once the connection is closed, or
+			// sends it again after reconnecting.
+			return call
+		default:
+			// The reader may already be past failing the calls that were
+			// pending when the connection was lost.
+			err = ConnectionLost
+		}
+
+		if c.remove(call.Request.RequestID, call) {
+			call.Error = err
+			call.done()
+		}
+	}
+
+	return call
+}
+
+// Do sends req and blocks until the matching reply arrives, ctx is done or
+// the connection fails.
+func (c *Client) Do(ctx context.Context, req *Request) (*Request, error) {
+	call := c.Go(req, make(chan *Call, 1))
+
+	select {
+	case <-call.Done:
+		return call.Reply, call.Error
+	case <-ctx.Done():
+		call.Cancel()
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) readReplies() {
+	var err error
+	lost := false
+
+	for {
+		err = c.readFrom(c.rwc)
+		if !c.shouldReconnect(err) {
+			break
+		}
+
+		if !c.redial() {
+			lost = true
+			break
+		}
+	}
+
+	if code := closeCodeForError(err); code != 0 {
+		// A writer blocked on a server that has stopped reading would hold
+		// the close frame back forever, so it only gets a moment to finish.
+		if deadlines, ok := c.rwc.(deadlineSetter); ok {
+			deadlines.SetWriteDeadline(time.Now().Add(closeTimeout))
+		}
+
+		closeRequest := NewCloseRequest(code, []byte(err.Error()))
+		go func() {
+			c.send(closeRequest)
+			c.rwc.Close()
+		}()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer close(c.done)
+
+	switch {
+	case c.peerClose != nil && isCloseError(c.peerClose.Code):
+		err = &CloseError{Reason: *c.peerClose}
+	case c.closing || c.peerClose != nil || err == io.EOF && !lost:
+		err = ClientClosed
+	case lost:
+		err = ConnectionLost
+	case c.unresponsive:
+		err = ServerUnresponsive
+	}
+
+	c.err = err
+	for requestID, call := range c.pending {
+		delete(c.pending, requestID)
+		call.Error = err
+		call.done()
+	}
+}
+
+// readFrom delivers the replies read from rwc until reading fails.
+func (c *Client) readFrom(rwc io.ReadWriteCloser) error {
+	decoder := NewDecoder(rwc)
+	decoder.MaxFrameSize = c.maxFrameSize
+	decoder.MaxRequestBytes = c.maxRequestBytes
+
+	for {
+		reply, err := decoder.Decode()
+		if err != nil {
+			return err
+		}
+
+		switch reply.OpCode {
+		case OPCODE_CLOSE:
+			c.handleClose(reply)
+			continue
+		case OPCODE_PING:
+			go c.send(&Request{OpCode: OPCODE_PONG, Priority: reply.Priority, RequestID: reply.RequestID})
+			continue
+		}
+
+		c.mu.Lock()
+		call, ok := c.pending[reply.RequestID]
+		delete(c.pending, reply.RequestID)
+		c.mu.Unlock()
+
+		if ok {
+			if reply.OpCode == OPCODE_ERROR {
+				call.Error = parseReplyError(reply)
+			} else {
+				call.Reply = reply
+			}
+			call.done()
+		} else if reply.flags&FLAG_PUSH != 0 {
+			c.handlePush(reply)
+		}
+	}
+}
+
+func (c *Client) handlePush(r *Request) {
+	if c.pushHandler == nil {
+		return
+	}
+
+	c.pushHandler(r)
+
+	if r.flags&FLAG_ACK != 0 {
+		go c.send(&Request{OpCode: OPCODE_ACK, RequestID: r.RequestID})
+	}
+}
+
+// handleClose answers a close frame from the server. If the server started
+// the handshake the frame is echoed and replies keep flowing until the server
+// closes the connection; if we started it, the handshake is complete.
+func (c *Client) handleClose(r *Request) {
+	reason := parseCloseReason(r)
+
+	c.mu.Lock()
+	c.peerClose = &reason
+	c.draining = true
+	sent := c.closeSent
+	c.closeSent = true
+	c.mu.Unlock()
+
+	if sent {
+		c.Close()
+		return
+	}
+
+	// The echo is sent asynchronously so that replies keep being read while
+	// a request is still being written.
+	go c.send(NewCloseRequest(reason.Code, nil))
+}
+
+// Shutdown performs a close handshake. New calls are rejected, the server
+// delivers the replies that are still pending and echoes the close frame,
+// and then the connection is closed. If ctx expires first the connection is
+// closed immediately.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	if c.closeSent || c.closing {
+		c.mu.Unlock()
+		return ClientClosed
+	}
+	c.draining = true
+	c.closeSent = true
+	c.mu.Unlock()
+
+	if err := c.send(NewCloseRequest(CLOSE_NORMAL, nil)); err != nil {
+		c.Close()
+		return err
+	}
+
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		c.Close()
+		return ctx.Err()
+	}
+}
+
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return ClientClosed
+	}
+	c.closing = true
+	rwc := c.rwc
+	close(c.quit)
+	c.mu.Unlock()
+
+	return rwc.Close()
+}
@@ -0,0 +1,395 @@
+package teaspoon
+
+import (
+	"context"
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientDo(t *testing.T) {
+	Convey("Concurrent requests on one connection should each receive their own reply", t, func() {
+		clientConn, serverConn := net.Pipe()
+		client := NewClient(clientConn)
+		defer client.Close()
+
+		go func() {
+			requests := []*Request{}
+			for len(requests) < 3 {
+				req, err := ReadRequest(serverConn)
+				if err != nil {
+					return
+				}
+				requests = append(requests, req)
+			}
+
+			// Reply in reverse order to prove replies are routed by request ID
+			for i := len(requests) - 1; i >= 0; i-- {
+				reply := &Request{
+					OpCode:    OPCODE_BINARY,
+					RequestID: requests[i].RequestID,
+					Payload:   append([]byte("RE "), requests[i].Payload...),
+				}
+				reply.WriteTo(serverConn)
+			}
+		}()
+
+		payloads := []string{"ONE", "TWO", "THREE"}
+		results := make(chan [2]string, len(payloads))
+
+		for _, payload := range payloads {
+			go func(payload string) {
+				reply, err := client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY, Payload: []byte(payload)})
+				if err != nil {
+					results <- [2]string{payload, err.Error()}
+					return
+				}
+				results <- [2]string{payload, string(reply.Payload)}
+			}(payload)
+		}
+
+		for range payloads {
+			result := <-results
+			So(result[1], ShouldEqual, "RE "+result[0])
+		}
+	})
+
+	Convey("A cancelled context should abandon the request", t, func() {
+		clientConn, serverConn := net.Pipe()
+		client := NewClient(clientConn)
+		defer client.Close()
+
+		go ReadRequest(serverConn)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+		defer cancel()
+
+		reply, err := client.Do(ctx, &Request{OpCode: OPCODE_BINARY, Payload: []byte("HELLO")})
+		So(reply, ShouldBeNil)
+		So(err, ShouldEqual, context.DeadlineExceeded)
+	})
+
+	Convey("A reply arriving after its call was cancelled should not be taken for a push", t, func() {
+		clientConn, serverConn := net.Pipe()
+		pushes := make(chan *Request, 1)
+		client := NewClient(clientConn, WithPushHandler(func(r *Request) { pushes <- r }))
+		defer client.Close()
+
+		cancelled := make(chan bool)
+		go func() {
+			decoder := NewDecoder(serverConn)
+			for _, payload := range []string{"LATE", "ON TIME"} {
+				req, err := decoder.Decode()
+				if err != nil {
+					return
+				}
+				if payload == "LATE" {
+					<-cancelled
+				}
+				(&Request{OpCode: OPCODE_BINARY, RequestID: req.RequestID, Payload: []byte(payload)}).WriteTo(serverConn)
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+		defer cancel()
+
+		_, err := client.Do(ctx, &Request{OpCode: OPCODE_BINARY})
+		So(err, ShouldEqual, context.DeadlineExceeded)
+		close(cancelled)
+
+		reply, err := client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY})
+		So(err, ShouldBeNil)
+		So(reply.Payload, ShouldResemble, []byte("ON TIME"))
+		So(len(pushes), ShouldEqual, 0)
+	})
+
+	Convey("Pending requests should fail when the connection is closed", t, func() {
+		clientConn, serverConn := net.Pipe()
+		client := NewClient(clientConn)
+
+		go func() {
+			ReadRequest(serverConn)
+			serverConn.Close()
+		}()
+
+		reply, err := client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY, Payload: []byte("HELLO")})
+		So(reply, ShouldBeNil)
+		So(err, ShouldEqual, ClientClosed)
+
+		reply, err = client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY})
+		So(reply, ShouldBeNil)
+		So(err, ShouldEqual, ClientClosed)
+	})
+}
+
+func TestClientGo(t *testing.T) {
+	Convey("Calls started with Go should be delivered on the shared done chan", t, func() {
+		clientConn, serverConn := net.Pipe()
+		client := NewClient(clientConn)
+		defer client.Close()
+
+		go func() {
+			for {
+				req, err := ReadRequest(serverConn)
+				if err != nil {
+					return
+				}
+
+				reply := &Request{OpCode: OPCODE_BINARY, RequestID: req.RequestID, Payload: req.Payload}
+				reply.WriteTo(serverConn)
+			}
+		}()
+
+		done := make(chan *Call, 5)
+		calls := map[*Call]bool{}
+		for i := 0; i < 5; i++ {
+			calls[client.Go(&Request{OpCode: OPCODE_BINARY, Payload: []byte{byte(i)}}, done)] = true
+		}
+
+		for i := 0; i < 5; i++ {
+			call := <-done
+			So(calls[call], ShouldBeTrue)
+			So(call.Error, ShouldBeNil)
+			So(call.Reply.Payload, ShouldResemble, call.Request.Payload)
+		}
+	})
+
+	Convey("A cancelled call should free its request ID and discard the late reply", t, func() {
+		clientConn, serverConn := net.Pipe()
+		client := NewClient(clientConn)
+		defer client.Close()
+
+		received := make(chan *Request, 2)
+		go func() {
+			for {
+				req, err := ReadRequest(serverConn)
+				if err != nil {
+					return
+				}
+				received <- req
+			}
+		}()
+
+		requestID := RequestID{1, 2, 3}
+		call := client.Go(&Request{OpCode: OPCODE_BINARY, RequestID: requestID}, nil)
+		req := <-received
+		So(req.RequestID, ShouldResemble, requestID)
+
+		call.Cancel()
+		So(<-call.Done, ShouldEqual, call)
+		So(call.Error, ShouldEqual, CallCanceled)
+
+		retry := client.Go(&Request{OpCode: OPCODE_BINARY, RequestID: requestID}, nil)
+		<-received
+		So(retry.Error, ShouldBeNil)
+
+		reply := &Request{OpCode: OPCODE_BINARY, RequestID: requestID, Payload: []byte("LATE")}
+		reply.WriteTo(serverConn)
+
+		So(<-retry.Done, ShouldEqual, retry)
+		So(retry.Reply.Payload, ShouldResemble, []byte("LATE"))
+		So(len(call.Done), ShouldEqual, 0)
+	})
+
+	Convey("Reusing the request ID of an in-flight call should fail", t, func() {
+		clientConn, serverConn := net.Pipe()
+		client := NewClient(clientConn)
+		defer client.Close()
+
+		go func() {
+			for {
+				if _, err := ReadRequest(serverConn); err != nil {
+					return
+				}
+			}
+		}()
+
+		client.Go(&Request{OpCode: OPCODE_BINARY, RequestID: RequestID{9}}, nil)
+		call := client.Go(&Request{OpCode: OPCODE_BINARY, RequestID: RequestID{9}}, nil)
+
+		So(<-call.Done, ShouldEqual, call)
+		So(call.Error, ShouldEqual, DuplicateRequestID)
+	})
+}
+
+func TestClientLimits(t *testing.T) {
+	Convey("A request over the server's size limit should fail with the server's close reason", t, func() {
+		errs := make(chan error, 1)
+		server := &Server{
+			Handler:         HandlerFunc(func(w ResponseWriter, r *Request) { w.Write(r.Payload) }),
+			MaxFrameSize:    5,
+			MaxRequestBytes: 8,
+			ErrorHook:       func(c io.Writer, err error) { errs <- err },
+		}
+
+		clientConn, serverConn := net.Pipe()
+		go newConn(serverConn, server).serve(context.Background())
+		client := NewClient(clientConn, WithMaxFrameSize(5))
+
+		reply, err := client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY, Payload: []byte("HELLO")})
+		So(err, ShouldBeNil)
+		So(reply.Payload, ShouldResemble, []byte("HELLO"))
+
+		reply, err = client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY, Payload: []byte("HELLO WORLD")})
+		So(reply, ShouldBeNil)
+		So(err, ShouldHaveSameTypeAs, &CloseError{})
+		So(err.(*CloseError).Reason.Code, ShouldEqual, CLOSE_TOO_LARGE)
+		So(<-errs, ShouldEqual, RequestPayloadLengthExceeded)
+	})
+
+	Convey("A reply over the client's size limit should close the connection", t, func() {
+		server := &Server{
+			Handler:   HandlerFunc(func(w ResponseWriter, r *Request) { w.Write([]byte("HELLO WORLD")) }),
+			ErrorHook: func(c io.Writer, err error) {},
+		}
+
+		clientConn, serverConn := net.Pipe()
+		go newConn(serverConn, server).serve(context.Background())
+		client := NewClient(clientConn, WithMaxRequestBytes(5))
+
+		reply, err := client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY})
+		So(reply, ShouldBeNil)
+		So(err, ShouldEqual, RequestPayloadLengthExceeded)
+	})
+}
+
+func TestClientErrorReply(t *testing.T) {
+	Convey("An error reply should fail the call with its status code and message", t, func() {
+		server := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+				w.Write([]byte("DISCARDED"))
+				w.WriteError(STATUS_BAD_REQUEST, "Missing payload")
+			}),
+		}
+
+		clientConn, serverConn := net.Pipe()
+		go newConn(serverConn, server).serve(context.Background())
+		client := NewClient(clientConn)
+		defer client.Close()
+
+		reply, err := client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY})
+		So(reply, ShouldBeNil)
+		So(err, ShouldResemble, &ReplyError{Code: STATUS_BAD_REQUEST, Message: "Missing payload"})
+		So(err.Error(), ShouldEqual, "The server replied with status 400: Missing payload")
+	})
+}
+
+func TestClientKeepAlive(t *testing.T) {
+	Convey("The client should answer pings from the server", t, func() {
+		clientConn, serverConn := net.Pipe()
+		client := NewClient(clientConn)
+		defer client.Close()
+
+		ping := &Request{OpCode: OPCODE_PING, Priority: 5, RequestID: NewRequestID()}
+		ping.WriteTo(serverConn)
+
+		pong, err := ReadRequest(serverConn)
+		So(err, ShouldBeNil)
+		So(pong.OpCode, ShouldEqual, OPCODE_PONG)
+		So(pong.RequestID, ShouldResemble, ping.RequestID)
+	})
+
+	Convey("A server answering pings should keep the connection alive", t, func() {
+		server := &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Request) { w.Write(r.Payload) })}
+
+		clientConn, serverConn := net.Pipe()
+		go newConn(serverConn, server).serve(context.Background())
+		client := NewClient(clientConn, WithKeepAlive(time.Millisecond*5, time.Millisecond*50))
+		defer client.Close()
+
+		time.Sleep(time.Millisecond * 30)
+
+		reply, err := client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY, Payload: []byte("ALIVE")})
+		So(err, ShouldBeNil)
+		So(reply.Payload, ShouldResemble, []byte("ALIVE"))
+	})
+
+	Convey("A server that stops answering pings should be considered dead", t, func() {
+		clientConn, serverConn := net.Pipe()
+		client := NewClient(clientConn, WithKeepAlive(time.Millisecond*10, time.Millisecond*20))
+		defer client.Close()
+
+		go func() {
+			for {
+				if _, err := ReadRequest(serverConn); err != nil {
+					return
+				}
+			}
+		}()
+
+		reply, err := client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY})
+		So(reply, ShouldBeNil)
+		So(err, ShouldEqual, ServerUnresponsive)
+	})
+}
+
+func TestClientReconnect(t *testing.T) {
+	echo := HandlerFunc(func(w ResponseWriter, r *Request) { w.Write(r.Payload) })
+
+	// dropFirst returns a dialer whose first connection is dropped by the
+	// server after it reads one request, while later ones are served by
+	// server.
+	dropFirst := func(server *Server) (io.ReadWriteCloser, func() (io.ReadWriteCloser, error)) {
+		clientConn, serverConn := net.Pipe()
+		go func() {
+			ReadRequest(serverConn)
+			serverConn.Close()
+		}()
+
+		return clientConn, func() (io.ReadWriteCloser, error) {
+			clientConn, serverConn := net.Pipe()
+			go newConn(serverConn, server).serve(context.Background())
+			return clientConn, nil
+		}
+	}
+
+	Convey("Pending calls should be sent again after reconnecting when RetryPending is set", t, func() {
+		rwc, dial := dropFirst(&Server{Handler: echo})
+		client := NewClient(rwc, WithReconnect(ReconnectPolicy{Dial: dial, MinBackoff: time.Millisecond, RetryPending: true}))
+		defer client.Close()
+
+		reply, err := client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY, Payload: []byte("AGAIN")})
+		So(err, ShouldBeNil)
+		So(reply.Payload, ShouldResemble, []byte("AGAIN"))
+	})
+
+	Convey("Pending calls should fail while later ones use the new connection", t, func() {
+		rwc, dial := dropFirst(&Server{Handler: echo})
+		client := NewClient(rwc, WithReconnect(ReconnectPolicy{Dial: dial, MinBackoff: time.Millisecond}))
+		defer client.Close()
+
+		reply, err := client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY, Payload: []byte("LOST")})
+		So(reply, ShouldBeNil)
+		So(err, ShouldEqual, ConnectionLost)
+
+		for {
+			reply, err = client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY, Payload: []byte("FOUND")})
+			if err != ConnectionLost {
+				break
+			}
+		}
+		So(err, ShouldBeNil)
+		So(reply.Payload, ShouldResemble, []byte("FOUND"))
+	})
+
+	Convey("The client should give up after MaxAttempts", t, func() {
+		attempts := 0
+		dial := func() (io.ReadWriteCloser, error) {
+			attempts++
+			return nil, errors.New("connection refused")
+		}
+
+		clientConn, serverConn := net.Pipe()
+		client := NewClient(clientConn, WithReconnect(ReconnectPolicy{Dial: dial, MinBackoff: time.Millisecond, MaxAttempts: 3, RetryPending: true}))
+		serverConn.Close()
+
+		<-client.done
+		So(attempts, ShouldEqual, 3)
+
+		_, err := client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY})
+		So(err, ShouldEqual, ConnectionLost)
+	})
+}
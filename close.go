@@ -0,0 +1,78 @@
+package teaspoon
+
+import (
+	"fmt"
+)
+
+const (
+	CLOSE_NORMAL           = 1000
+	CLOSE_GOING_AWAY       = 1001
+	CLOSE_PROTOCOL_ERROR   = 1002
+	CLOSE_NO_STATUS        = 1005
+	CLOSE_ABNORMAL         = 1006
+	CLOSE_POLICY_VIOLATION = 1008
+	CLOSE_TOO_LARGE        = 1009
+)
+
+// CloseReason describes why a connection was closed. Code is CLOSE_ABNORMAL
+// when the peer disconnected without a close frame.
+type CloseReason struct {
+	Code    int
+	Payload []byte
+}
+
+// NewCloseRequest builds a close frame carrying code and an optional payload.
+func NewCloseRequest(code int, payload []byte) *Request {
+	return &Request{
+		OpCode:    OPCODE_CLOSE,
+		RequestID: NewRequestID(),
+		Payload:   append([]byte{byte(code >> 8), byte(code)}, payload...),
+	}
+}
+
+// CloseError is returned for calls that were pending when the peer closed
+// the connection because of an error.
+type CloseError struct {
+	Reason CloseReason
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("The connection was closed by the peer with code %d: %s", e.Reason.Code, e.Reason.Payload)
+}
+
+// isCloseError reports whether code indicates the connection was closed
+// because of a failure rather than by choice.
+func isCloseError(code int) bool {
+	switch code {
+	case CLOSE_NORMAL, CLOSE_GOING_AWAY, CLOSE_NO_STATUS:
+		return false
+	}
+
+	return true
+}
+
+// closeCodeForError returns the close code that reports err to the peer, or
+// zero if err does not warrant one.
+func closeCodeForError(err error) int {
+	switch err {
+	case PacketPayloadLengthExceeded, RequestPayloadLengthExceeded:
+		return CLOSE_TOO_LARGE
+	case TooManyOpenRequests:
+		return CLOSE_POLICY_VIOLATION
+	case InvalidPacketSequence, DuplicatePacket, InconsistentPacketHeader:
+		return CLOSE_PROTOCOL_ERROR
+	}
+
+	return 0
+}
+
+func parseCloseReason(r *Request) CloseReason {
+	if len(r.Payload) < 2 {
+		return CloseReason{Code: CLOSE_NO_STATUS}
+	}
+
+	return CloseReason{
+		Code:    (int(r.Payload[0]) << 8) + int(r.Payload[1]),
+		Payload: r.Payload[2:],
+	}
+}
@@ -0,0 +1,233 @@
+package teaspoon
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// DefaultMaxOpenRequests is the number of requests a Decoder reassembles at
+// once unless MaxOpenRequests is set.
+const DefaultMaxOpenRequests = 1024
+
+var (
+	TooManyOpenRequests      = errors.New("Too many requests are being reassembled at once")
+	DuplicatePacket          = errors.New("A packet with the same sequence was already received for the request")
+	InconsistentPacketHeader = errors.New("The packet's header does not match the other packets of its request")
+)
+
+// partialRequest collects the packets of a request by sequence. total is the
+// number of packets expected, which for a streamed request is only known once
+// its final packet arrives.
+type partialRequest struct {
+	first   *Packet
+	packets map[int32]*Packet
+	total   int32
+	length  int64
+	started time.Time
+}
+
+func newPartialRequest(first *Packet) *partialRequest {
+	return &partialRequest{
+		first:   first,
+		packets: make(map[int32]*Packet),
+		total:   first.totalSequences,
+		started: time.Now(),
+	}
+}
+
+// add places packet by its sequence, rejecting duplicates and packets whose
+// header disagrees with the other packets of the request.
+func (p *partialRequest) add(packet *Packet) error {
+	if packet.opCode != p.first.opCode || packet.method != p.first.method || packet.totalSequences != p.first.totalSequences {
+		return InconsistentPacketHeader
+	}
+
+	if _, ok := p.packets[packet.sequence]; ok {
+		return DuplicatePacket
+	}
+
+	if p.total > 0 && packet.sequence >= p.total {
+		return InvalidPacketSequence
+	}
+
+	if packet.totalSequences == 0 && packet.flags&FLAG_FINAL != 0 {
+		if p.total > 0 {
+			return InvalidPacketSequence
+		}
+
+		for sequence := range p.packets {
+			if sequence > packet.sequence {
+				return InvalidPacketSequence
+			}
+		}
+
+		p.total = packet.sequence + 1
+	}
+
+	p.packets[packet.sequence] = packet
+	p.length += int64(packet.payloadLength)
+
+	return nil
+}
+
+func (p *partialRequest) complete() bool {
+	return p.total > 0 && int32(len(p.packets)) == p.total
+}
+
+// ordered returns the packets of a complete request in sequence order.
+func (p *partialRequest) ordered() []*Packet {
+	packets := make([]*Packet, p.total)
+	for sequence, packet := range p.packets {
+		packets[sequence] = packet
+	}
+
+	return packets
+}
+
+// Decoder reads requests from a stream of frames. The frames of several
+// requests may be interleaved and arrive out of order; each request is
+// returned once all of its frames have arrived. A Decoder is not safe for
+// concurrent use.
+type Decoder struct {
+	// MaxFrameSize is the largest frame payload accepted. Zero means
+	// DefaultMaxFrameSize.
+	MaxFrameSize int
+
+	// MaxRequestBytes limits the total payload of a request. Zero means no
+	// limit.
+	MaxRequestBytes int64
+
+	// MaxOpenRequests limits how many requests may be partially received at
+	// once. Zero means DefaultMaxOpenRequests.
+	MaxOpenRequests int
+
+	r        io.Reader
+	partials map[RequestID]*partialRequest
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r, partials: make(map[RequestID]*partialRequest)}
+}
+
+// Decode reads frames until a request is complete and returns it.
+func (d *Decoder) Decode() (*Request, error) {
+	for {
+		packet, err := d.readPacket(d.r)
+		if err != nil {
+			return nil, err
+		}
+
+		if request, complete, err := d.add(packet); complete || err != nil {
+			return request, err
+		}
+	}
+}
+
+func (d *Decoder) maxFrameSize() int {
+	if d.MaxFrameSize > 0 {
+		return d.MaxFrameSize
+	}
+
+	return DefaultMaxFrameSize
+}
+
+func (d *Decoder) maxOpenRequests() int {
+	if d.MaxOpenRequests > 0 {
+		return d.MaxOpenRequests
+	}
+
+	return DefaultMaxOpenRequests
+}
+
+// readPacket reads the next packet from src, which must deliver the frames
+// of d's stream. The packet is rejected before its payload is allocated if it
+// is too large or would open one request too many.
+func (d *Decoder) readPacket(src io.Reader) (*Packet, error) {
+	packet, err := readPacketHeader(src, d.maxFrameSize())
+	if err != nil {
+		return nil, err
+	}
+
+	length := int64(0)
+	if partial := d.partial(packet); partial != nil {
+		length = partial.length
+	} else if !packet.isSingle() && len(d.partials) >= d.maxOpenRequests() {
+		return nil, TooManyOpenRequests
+	}
+
+	if d.MaxRequestBytes > 0 && length+int64(packet.payloadLength) > d.MaxRequestBytes {
+		return nil, RequestPayloadLengthExceeded
+	}
+
+	if err := readPacketPayload(src, packet); err != nil {
+		return nil, err
+	}
+
+	return packet, nil
+}
+
+// add stores packet with the other packets received for the same request ID.
+// Packets may arrive in any order; once every sequence is present the request
+// is assembled and complete is true. A request with an invalid packet is
+// discarded.
+func (d *Decoder) add(packet *Packet) (request *Request, complete bool, err error) {
+	partial := d.partial(packet)
+	if partial == nil {
+		partial = newPartialRequest(packet)
+		d.partials[packet.requestId] = partial
+	}
+
+	if err := partial.add(packet); err != nil {
+		delete(d.partials, packet.requestId)
+
+		return nil, false, err
+	}
+
+	if partial.complete() {
+		delete(d.partials, packet.requestId)
+		request, err = constructRequest(partial.ordered())
+
+		return request, true, err
+	}
+
+	return nil, false, nil
+}
+
+// partial returns the request packet belongs to. An error reply aborts a
+// streamed reply with the same request ID, whose packets are discarded.
+func (d *Decoder) partial(packet *Packet) *partialRequest {
+	partial := d.partials[packet.requestId]
+	if partial != nil && packet.opCode == OPCODE_ERROR && partial.first.opCode != OPCODE_ERROR && partial.first.totalSequences == 0 {
+		delete(d.partials, packet.requestId)
+		return nil
+	}
+
+	return partial
+}
+
+// oldest returns when the oldest partially received request was started.
+func (d *Decoder) oldest() (time.Time, bool) {
+	oldest := time.Time{}
+	for _, partial := range d.partials {
+		if oldest.IsZero() || partial.started.Before(oldest) {
+			oldest = partial.started
+		}
+	}
+
+	return oldest, !oldest.IsZero()
+}
+
+// expire discards the partially received requests that were started before
+// deadline and returns their request IDs.
+func (d *Decoder) expire(deadline time.Time) []RequestID {
+	expired := []RequestID{}
+	for requestID, partial := range d.partials {
+		if partial.started.Before(deadline) {
+			delete(d.partials, requestID)
+			expired = append(expired, requestID)
+		}
+	}
+
+	return expired
+}
@@ -0,0 +1,184 @@
+package teaspoon
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"testing"
+)
+
+func TestDecoderDecode(t *testing.T) {
+	Convey("Interleaved requests should each be reassembled", t, func() {
+		first := &Request{OpCode: OPCODE_BINARY, RequestID: RequestID{1}, Payload: []byte("HELLO WORLD")}
+		second := &Request{OpCode: OPCODE_TEXT, RequestID: RequestID{2}, Payload: []byte("GOODBYE")}
+
+		buffer := bytes.NewBuffer([]byte{})
+		firstFrames, secondFrames := first.GetFrames(5), second.GetFrames(5)
+		for i := range firstFrames {
+			buffer.Write(firstFrames[i])
+			if i < len(secondFrames) {
+				buffer.Write(secondFrames[i])
+			}
+		}
+
+		decoder := NewDecoder(buffer)
+
+		request, err := decoder.Decode()
+		So(err, ShouldBeNil)
+		So(request.RequestID, ShouldResemble, second.RequestID)
+		So(request.Payload, ShouldResemble, second.Payload)
+
+		request, err = decoder.Decode()
+		So(err, ShouldBeNil)
+		So(request.RequestID, ShouldResemble, first.RequestID)
+		So(request.Payload, ShouldResemble, first.Payload)
+
+		_, err = decoder.Decode()
+		So(err, ShouldEqual, io.EOF)
+	})
+}
+
+func TestDecoderLimits(t *testing.T) {
+	request := &Request{OpCode: OPCODE_BINARY, RequestID: RequestID{1}, Payload: []byte("HELLO WORLD")}
+
+	Convey("A frame larger than the maximum frame size should be rejected", t, func() {
+		buffer := bytes.NewBuffer([]byte{})
+		request.writeFrames(buffer, 11)
+
+		decoder := NewDecoder(buffer)
+		decoder.MaxFrameSize = 10
+
+		reply, err := decoder.Decode()
+		So(reply, ShouldBeNil)
+		So(err, ShouldEqual, PacketPayloadLengthExceeded)
+	})
+
+	Convey("A request larger than the maximum request size should be rejected before the payload is read", t, func() {
+		buffer := bytes.NewBuffer([]byte{})
+		request.writeFrames(buffer, 5)
+
+		decoder := NewDecoder(buffer)
+		decoder.MaxFrameSize = 5
+		decoder.MaxRequestBytes = 8
+
+		reply, err := decoder.Decode()
+		So(reply, ShouldBeNil)
+		So(err, ShouldEqual, RequestPayloadLengthExceeded)
+		So(buffer.Len(), ShouldEqual, 5+28+1)
+	})
+
+	Convey("A request within the limits should be read", t, func() {
+		buffer := bytes.NewBuffer([]byte{})
+		request.writeFrames(buffer, 5)
+
+		decoder := NewDecoder(buffer)
+		decoder.MaxFrameSize = 5
+		decoder.MaxRequestBytes = 11
+
+		reply, err := decoder.Decode()
+		So(err, ShouldBeNil)
+		So(reply.Payload, ShouldResemble, request.Payload)
+	})
+
+	Convey("Starting more requests than MaxOpenRequests should be rejected", t, func() {
+		buffer := bytes.NewBuffer([]byte{})
+		for i := byte(1); i <= 3; i++ {
+			partial := &Request{OpCode: OPCODE_BINARY, RequestID: RequestID{i}, Payload: []byte("HELLO WORLD")}
+			buffer.Write(partial.GetFrames(5)[0])
+		}
+
+		decoder := NewDecoder(buffer)
+		decoder.MaxOpenRequests = 2
+
+		_, err := decoder.Decode()
+		So(err, ShouldEqual, TooManyOpenRequests)
+		So(len(decoder.partials), ShouldEqual, 2)
+	})
+
+	Convey("A single frame request should not count against MaxOpenRequests", t, func() {
+		buffer := bytes.NewBuffer([]byte{})
+		partial := &Request{OpCode: OPCODE_BINARY, RequestID: RequestID{1}, Payload: []byte("HELLO WORLD")}
+		buffer.Write(partial.GetFrames(5)[0])
+		(&Request{OpCode: OPCODE_BINARY, RequestID: RequestID{2}, Payload: []byte("HI")}).WriteTo(buffer)
+
+		decoder := NewDecoder(buffer)
+		decoder.MaxOpenRequests = 1
+
+		reply, err := decoder.Decode()
+		So(err, ShouldBeNil)
+		So(reply.RequestID, ShouldResemble, RequestID{2})
+	})
+}
+
+func TestDecoderReassembly(t *testing.T) {
+	request := &Request{OpCode: OPCODE_BINARY, Method: 3, RequestID: RequestID{1}, Payload: []byte("HELLO WORLD")}
+	frames := request.GetFrames(5)
+
+	decode := func(frames ...[]byte) (*Request, *Decoder, error) {
+		decoder := NewDecoder(bytes.NewBuffer(bytes.Join(frames, nil)))
+		request, err := decoder.Decode()
+		return request, decoder, err
+	}
+
+	Convey("Frames arriving out of order should be placed by their sequence", t, func() {
+		reply, _, err := decode(frames[2], frames[0], frames[1])
+		So(err, ShouldBeNil)
+		So(reply.Method, ShouldEqual, 3)
+		So(reply.Payload, ShouldResemble, request.Payload)
+	})
+
+	Convey("A streamed request should complete once every frame up to the final one has arrived", t, func() {
+		streamed := &Request{OpCode: OPCODE_BINARY, RequestID: RequestID{2}}
+		reply, _, err := decode(
+			streamed.frame(1, 0, 0, []byte(" WORLD")),
+			streamed.frame(2, 0, FLAG_FINAL, []byte("!")),
+			streamed.frame(0, 0, 0, []byte("HELLO")),
+		)
+		So(err, ShouldBeNil)
+		So(reply.Payload, ShouldResemble, []byte("HELLO WORLD!"))
+	})
+
+	Convey("An error reply should replace the streamed frames of its request", t, func() {
+		streamed := &Request{OpCode: OPCODE_BINARY, RequestID: RequestID{2}}
+		failed := &Request{OpCode: OPCODE_ERROR, RequestID: RequestID{2}, Payload: statusPayload(STATUS_INTERNAL_ERROR, "FAILED")}
+		reply, decoder, err := decode(
+			streamed.frame(0, 0, 0, []byte("HELLO")),
+			bytes.Join(failed.GetFrames(4), nil),
+		)
+		So(err, ShouldBeNil)
+		So(reply.OpCode, ShouldEqual, OPCODE_ERROR)
+		So(reply.Payload, ShouldResemble, failed.Payload)
+		So(len(decoder.partials), ShouldEqual, 0)
+	})
+
+	Convey("A request with a missing frame should not complete", t, func() {
+		_, decoder, err := decode(frames[0], frames[2])
+		So(err, ShouldEqual, io.EOF)
+		So(len(decoder.partials), ShouldEqual, 1)
+	})
+
+	Convey("A duplicated frame should be rejected", t, func() {
+		_, decoder, err := decode(frames[0], frames[0], frames[1], frames[2])
+		So(err, ShouldEqual, DuplicatePacket)
+		So(len(decoder.partials), ShouldEqual, 0)
+	})
+
+	Convey("Frames disagreeing on their header should be rejected", t, func() {
+		other := *request
+		other.Method = 4
+		_, _, err := decode(frames[0], other.GetFrames(5)[1])
+		So(err, ShouldEqual, InconsistentPacketHeader)
+
+		_, _, err = decode(frames[0], request.GetFrames(2)[1])
+		So(err, ShouldEqual, InconsistentPacketHeader)
+	})
+
+	Convey("Frames beyond the total sequences should be rejected", t, func() {
+		_, _, err := decode(frames[0], request.frame(3, 3, 0, []byte("!")))
+		So(err, ShouldEqual, InvalidPacketSequence)
+
+		streamed := &Request{OpCode: OPCODE_BINARY, RequestID: RequestID{2}}
+		_, _, err = decode(streamed.frame(1, 0, FLAG_FINAL, nil), streamed.frame(2, 0, 0, nil))
+		So(err, ShouldEqual, InvalidPacketSequence)
+	})
+}
@@ -0,0 +1,245 @@
+package teaspoon
+
+import (
+	"errors"
+	"sync"
+)
+
+const (
+	// OVERLOAD_QUEUE makes the connection wait for capacity, which stops it
+	// from reading further requests until a worker frees up.
+	OVERLOAD_QUEUE = iota
+	// OVERLOAD_REJECT replies to the request with an error.
+	OVERLOAD_REJECT
+	// OVERLOAD_DROP discards the request and reports it to Server.ErrorHook.
+	OVERLOAD_DROP
+)
+
+var (
+	ServerOverloaded = errors.New("The server is overloaded")
+)
+
+// PriorityBand is a pool of workers serving requests whose priority is at
+// least MinPriority and below the MinPriority of the next band.
+type PriorityBand struct {
+	MinPriority byte
+	Workers     int
+	QueueSize   int
+}
+
+// Dispatcher runs handlers on bounded worker pools instead of a goroutine
+// per request. A Dispatcher must not be shared between servers.
+type Dispatcher struct {
+	// Bands splits requests into worker pools by priority. Without any bands
+	// all requests share a single worker.
+	Bands []PriorityBand
+
+	// MaxInFlightPerConn and MaxInFlight limit the number of requests being
+	// queued or handled per connection and per server. Zero means no limit.
+	MaxInFlightPerConn int
+	MaxInFlight        int
+
+	// Overload is one of OVERLOAD_QUEUE, OVERLOAD_REJECT or OVERLOAD_DROP.
+	Overload int
+
+	once  sync.Once
+	pools []*workerPool
+	slots chan bool
+	quit  chan bool
+	stop  sync.Once
+
+	// mu keeps close from draining the pools while a job is being queued.
+	mu sync.RWMutex
+}
+
+// job is a queued request. drop is called instead of run if the dispatcher
+// is closed before a worker picks the job up.
+type job struct {
+	run  func()
+	drop func()
+}
+
+// workerPool accepts as many jobs as it has workers and queue entries.
+// slots counts the accepted jobs, so sending on jobs never blocks.
+type workerPool struct {
+	minPriority byte
+	jobs        chan job
+	slots       chan bool
+}
+
+func (d *Dispatcher) start() {
+	bands := d.Bands
+	if len(bands) == 0 {
+		bands = []PriorityBand{{Workers: 1}}
+	}
+
+	d.quit = make(chan bool)
+	if d.MaxInFlight > 0 {
+		d.slots = make(chan bool, d.MaxInFlight)
+	}
+
+	for _, band := range bands {
+		workers := band.Workers
+		if workers <= 0 {
+			workers = 1
+		}
+
+		pool := &workerPool{
+			minPriority: band.MinPriority,
+			jobs:        make(chan job, workers+band.QueueSize),
+			slots:       make(chan bool, workers+band.QueueSize),
+		}
+		d.pools = append(d.pools, pool)
+
+		for i := 0; i < workers; i++ {
+			go pool.work(d.quit)
+		}
+	}
+}
+
+func (p *workerPool) work(quit chan bool) {
+	for {
+		select {
+		case job := <-p.jobs:
+			job.run()
+		case <-quit:
+			return
+		}
+	}
+}
+
+// drain drops the jobs no worker has picked up.
+func (p *workerPool) drain() {
+	for {
+		select {
+		case job := <-p.jobs:
+			job.drop()
+		default:
+			return
+		}
+	}
+}
+
+// close stops the workers and drops the queued jobs. Requests dispatched
+// afterwards are refused.
+func (d *Dispatcher) close() {
+	d.once.Do(d.start)
+	d.stop.Do(func() {
+		d.mu.Lock()
+		close(d.quit)
+		d.mu.Unlock()
+
+		for _, pool := range d.pools {
+			pool.drain()
+		}
+	})
+}
+
+func (d *Dispatcher) pool(priority byte) *workerPool {
+	var selected *workerPool
+
+	for _, pool := range d.pools {
+		if pool.minPriority <= priority && (selected == nil || pool.minPriority > selected.minPriority) {
+			selected = pool
+		}
+	}
+
+	if selected == nil {
+		selected = d.pools[0]
+	}
+
+	return selected
+}
+
+func (d *Dispatcher) acquire(slots chan bool, done <-chan bool) bool {
+	if slots == nil {
+		return true
+	}
+
+	if d.Overload == OVERLOAD_QUEUE {
+		select {
+		case slots <- true:
+			return true
+		case <-done:
+			return false
+		case <-d.quit:
+			return false
+		}
+	}
+
+	select {
+	case slots <- true:
+		return true
+	default:
+		return false
+	}
+}
+
+func release(slots chan bool) {
+	if slots != nil {
+		<-slots
+	}
+}
+
+// dispatch queues run on the pool serving priority. connSlots limits the
+// requests of the connection it belongs to, and done is closed when that
+// connection goes away. ServerOverloaded is returned if the job could not
+// be queued. If the dispatcher is closed before the job runs, drop is called
+// instead, unless it is nil.
+func (d *Dispatcher) dispatch(priority byte, connSlots chan bool, done <-chan bool, run func(), drop func()) error {
+	d.once.Do(d.start)
+
+	select {
+	case <-d.quit:
+		return ServerOverloaded
+	default:
+	}
+
+	if !d.acquire(connSlots, done) {
+		return ServerOverloaded
+	}
+
+	if !d.acquire(d.slots, done) {
+		release(connSlots)
+		return ServerOverloaded
+	}
+
+	pool := d.pool(priority)
+
+	if !d.acquire(pool.slots, done) {
+		release(d.slots)
+		release(connSlots)
+		return ServerOverloaded
+	}
+
+	releaseAll := func() {
+		release(pool.slots)
+		release(d.slots)
+		release(connSlots)
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	select {
+	case <-d.quit:
+		releaseAll()
+		return ServerOverloaded
+	default:
+	}
+
+	pool.jobs <- job{
+		run: func() {
+			defer releaseAll()
+			run()
+		},
+		drop: func() {
+			defer releaseAll()
+			if drop != nil {
+				drop()
+			}
+		},
+	}
+
+	return nil
+}
@@ -0,0 +1,234 @@
+package teaspoon
+
+import (
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDispatcherDispatch(t *testing.T) {
+	Convey("A band should never run more jobs than it has workers", t, func() {
+		d := &Dispatcher{Bands: []PriorityBand{{Workers: 2, QueueSize: 10}}}
+		defer d.close()
+
+		var running, highest int32
+		finished := make(chan bool, 6)
+
+		for i := 0; i < 6; i++ {
+			err := d.dispatch(0, nil, nil, func() {
+				n := atomic.AddInt32(&running, 1)
+				for {
+					max := atomic.LoadInt32(&highest)
+					if n <= max || atomic.CompareAndSwapInt32(&highest, max, n) {
+						break
+					}
+				}
+
+				time.Sleep(time.Millisecond * 5)
+				atomic.AddInt32(&running, -1)
+				finished <- true
+			}, nil)
+			So(err, ShouldBeNil)
+		}
+
+		for i := 0; i < 6; i++ {
+			<-finished
+		}
+		So(atomic.LoadInt32(&highest), ShouldEqual, 2)
+	})
+
+	Convey("Requests should be served by the band matching their priority", t, func() {
+		d := &Dispatcher{Bands: []PriorityBand{{MinPriority: 0, Workers: 1}, {MinPriority: 8, Workers: 1}}}
+		defer d.close()
+
+		block := make(chan bool)
+		defer close(block)
+
+		So(d.dispatch(2, nil, nil, func() { <-block }, nil), ShouldBeNil)
+
+		done := make(chan bool)
+		So(d.dispatch(12, nil, nil, func() { close(done) }, nil), ShouldBeNil)
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			So("the high priority band was blocked", ShouldBeEmpty)
+		}
+	})
+
+	Convey("A full connection should be rejected or made to wait depending on the overload behavior", t, func() {
+		block := make(chan bool)
+		slots := make(chan bool, 1)
+
+		reject := &Dispatcher{Bands: []PriorityBand{{Workers: 2}}, Overload: OVERLOAD_REJECT}
+		defer reject.close()
+
+		So(reject.dispatch(0, slots, nil, func() { <-block }, nil), ShouldBeNil)
+		So(reject.dispatch(0, slots, nil, func() {}, nil), ShouldEqual, ServerOverloaded)
+
+		queue := &Dispatcher{Bands: []PriorityBand{{Workers: 2}}, MaxInFlight: 1}
+		defer queue.close()
+
+		So(queue.dispatch(0, nil, nil, func() { <-block }, nil), ShouldBeNil)
+
+		dispatched := make(chan error)
+		go func() {
+			dispatched <- queue.dispatch(0, nil, nil, func() {}, nil)
+		}()
+
+		select {
+		case <-dispatched:
+			So("the second request was not queued", ShouldBeEmpty)
+		case <-time.After(time.Millisecond * 20):
+		}
+
+		close(block)
+		So(<-dispatched, ShouldBeNil)
+	})
+
+	Convey("A closed dispatcher should refuse new jobs", t, func() {
+		d := &Dispatcher{}
+		d.close()
+
+		So(d.dispatch(0, nil, nil, func() {}, nil), ShouldEqual, ServerOverloaded)
+	})
+}
+
+func TestServerDispatcher(t *testing.T) {
+	Convey("Requests over the in-flight limit should receive an error reply under OVERLOAD_REJECT", t, func() {
+		block := make(chan bool)
+		server := &Server{
+			Handler:    HandlerFunc(func(w ResponseWriter, r *Request) { <-block; w.Write(r.Payload) }),
+			Dispatcher: &Dispatcher{Bands: []PriorityBand{{Workers: 4}}, MaxInFlightPerConn: 1, Overload: OVERLOAD_REJECT},
+			ErrorHook:  func(c io.Writer, err error) {},
+		}
+		defer server.Close()
+
+		clientConn, serverConn := net.Pipe()
+		go newConn(serverConn, server).serve(context.Background())
+		client := NewClient(clientConn)
+		defer client.Close()
+
+		first := client.Go(&Request{OpCode: OPCODE_BINARY, Payload: []byte("FIRST")}, nil)
+
+		reply, err := client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY, Payload: []byte("SECOND")})
+		So(reply, ShouldBeNil)
+		So(err, ShouldResemble, &ReplyError{Code: STATUS_UNAVAILABLE, Message: ServerOverloaded.Error()})
+
+		close(block)
+		<-first.Done
+		So(first.Error, ShouldBeNil)
+		So(first.Reply.Payload, ShouldResemble, []byte("FIRST"))
+	})
+
+	Convey("Rejecting a request should not disturb a reply being written by another handler", t, func() {
+		started := make(chan bool)
+		block := make(chan bool)
+		server := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+				w.Write([]byte("FIR"))
+				started <- true
+				<-block
+				w.Write([]byte("ST"))
+			}),
+			Dispatcher: &Dispatcher{Bands: []PriorityBand{{Workers: 4}}, MaxInFlightPerConn: 1, Overload: OVERLOAD_REJECT},
+			ErrorHook:  func(c io.Writer, err error) {},
+		}
+		defer server.Close()
+
+		clientConn, serverConn := net.Pipe()
+		go newConn(serverConn, server).serve(context.Background())
+		client := NewClient(clientConn)
+		defer client.Close()
+
+		first := client.Go(&Request{OpCode: OPCODE_BINARY}, nil)
+		<-started
+
+		for i := 0; i < 3; i++ {
+			_, err := client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY})
+			So(err, ShouldResemble, &ReplyError{Code: STATUS_UNAVAILABLE, Message: ServerOverloaded.Error()})
+		}
+
+		close(block)
+		<-first.Done
+		So(first.Error, ShouldBeNil)
+		So(first.Reply.Payload, ShouldResemble, []byte("FIRST"))
+	})
+
+	Convey("Requests over the in-flight limit should be reported and dropped under OVERLOAD_DROP", t, func() {
+		block := make(chan bool)
+		errs := make(chan error, 1)
+		server := &Server{
+			Handler:    HandlerFunc(func(w ResponseWriter, r *Request) { <-block; w.Write(r.Payload) }),
+			Dispatcher: &Dispatcher{Bands: []PriorityBand{{Workers: 4}}, MaxInFlight: 1, Overload: OVERLOAD_DROP},
+			ErrorHook:  func(c io.Writer, err error) { errs <- err },
+		}
+		defer server.Close()
+
+		clientConn, serverConn := net.Pipe()
+		go newConn(serverConn, server).serve(context.Background())
+		client := NewClient(clientConn)
+		defer client.Close()
+
+		first := client.Go(&Request{OpCode: OPCODE_BINARY, Payload: []byte("FIRST")}, nil)
+		second := client.Go(&Request{OpCode: OPCODE_BINARY, Payload: []byte("SECOND")}, nil)
+
+		So(<-errs, ShouldEqual, ServerOverloaded)
+
+		close(block)
+		<-first.Done
+		So(first.Reply.Payload, ShouldResemble, []byte("FIRST"))
+		So(len(second.Done), ShouldEqual, 0)
+	})
+}
+
+func TestServerDispatcherClose(t *testing.T) {
+	Convey("Closing the server should finish the requests still queued in the dispatcher", t, func() {
+		var served int32
+		block := make(chan bool)
+		d := &Dispatcher{Bands: []PriorityBand{{Workers: 1, QueueSize: 2}}}
+		server := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+				atomic.AddInt32(&served, 1)
+				<-block
+			}),
+			Dispatcher: d,
+		}
+		d.once.Do(d.start)
+
+		clientConn, serverConn := net.Pipe()
+		c := newConn(serverConn, server)
+		server.trackConn(c, true)
+		go c.serve(context.Background())
+		client := NewClient(clientConn)
+		defer client.Close()
+
+		for i := 0; i < 3; i++ {
+			client.Go(&Request{OpCode: OPCODE_BINARY}, nil)
+		}
+
+		for len(d.pools[0].slots) < 3 {
+			time.Sleep(time.Millisecond)
+		}
+
+		server.Close()
+		close(block)
+
+		finished := make(chan bool)
+		go func() {
+			c.handlers.Wait()
+			close(finished)
+		}()
+
+		select {
+		case <-finished:
+		case <-time.After(time.Second):
+			So("the queued requests were never finished", ShouldBeEmpty)
+		}
+		So(atomic.LoadInt32(&served), ShouldEqual, 1)
+	})
+}
@@ -0,0 +1,90 @@
+package teaspoon
+
+import (
+	"sync"
+)
+
+// frameQueue buffers outgoing frames with one FIFO per priority. pop always
+// returns the oldest frame of the highest priority, so the frames of an
+// urgent reply overtake those of a bulky one that was queued earlier while
+// the frames of a single reply stay in order.
+type frameQueue struct {
+	mu       sync.Mutex
+	frames   [16][][]byte
+	length   int
+	capacity int
+	ready    chan bool
+	space    chan bool
+}
+
+func newFrameQueue(capacity int) *frameQueue {
+	return &frameQueue{
+		capacity: capacity,
+		ready:    make(chan bool, 1),
+		space:    make(chan bool, 1),
+	}
+}
+
+func framePriority(frame []byte) byte {
+	if len(frame) == 0 {
+		return 0
+	}
+
+	return frame[0] & 0x0F
+}
+
+func signal(c chan bool) {
+	select {
+	case c <- true:
+	default:
+	}
+}
+
+// push queues frame, blocking while the queue is full. It gives up with
+// ConnClosed once done is closed.
+func (q *frameQueue) push(frame []byte, done <-chan bool) error {
+	for {
+		q.mu.Lock()
+		if q.length < q.capacity {
+			priority := framePriority(frame)
+			q.frames[priority] = append(q.frames[priority], frame)
+			q.length++
+			q.mu.Unlock()
+
+			signal(q.ready)
+			return nil
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.space:
+		case <-done:
+			return ConnClosed
+		}
+	}
+}
+
+func (q *frameQueue) pop() ([]byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for priority := len(q.frames) - 1; priority >= 0; priority-- {
+		if len(q.frames[priority]) == 0 {
+			continue
+		}
+
+		frame := q.frames[priority][0]
+		q.frames[priority][0] = nil
+		q.frames[priority] = q.frames[priority][1:]
+		q.length--
+
+		signal(q.space)
+		if q.length > 0 {
+			signal(q.ready)
+		}
+
+		return frame, true
+	}
+
+	return nil, false
+}
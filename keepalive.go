@@ -0,0 +1,198 @@
+package teaspoon
+
+import (
+	"io"
+	"time"
+)
+
+const (
+	DefaultMinBackoff = time.Millisecond * 100
+	DefaultMaxBackoff = time.Second * 30
+)
+
+// ReconnectPolicy controls how a Client recovers from a lost connection.
+// Connections closed by Close, Shutdown or a close frame from the server are
+// not recovered.
+type ReconnectPolicy struct {
+	// Dial opens a new connection. Clients created by Dial redial the same
+	// address when it is nil.
+	Dial func() (io.ReadWriteCloser, error)
+
+	// MinBackoff is the delay after the first failed attempt, doubling with
+	// every further attempt up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// MaxAttempts limits the attempts per lost connection. Zero means no
+	// limit.
+	MaxAttempts int
+
+	// RetryPending sends the calls that were in flight when the connection
+	// was lost again on the new connection, so the server may receive them
+	// twice. Otherwise they fail with ConnectionLost.
+	RetryPending bool
+}
+
+// WithKeepAlive makes the client ping the server every interval. A server
+// that does not answer within timeout is considered dead and its connection
+// is closed, failing pending calls with ServerUnresponsive unless the client
+// reconnects.
+func WithKeepAlive(interval time.Duration, timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.keepAliveInterval = interval
+		c.keepAliveTimeout = timeout
+	}
+}
+
+// WithReconnect makes the client reconnect with exponential backoff when the
+// connection is lost.
+func WithReconnect(policy ReconnectPolicy) ClientOption {
+	return func(c *Client) {
+		c.reconnect = &policy
+	}
+}
+
+func (c *Client) keepAlive() {
+	ticker := time.NewTicker(c.keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		call := c.Go(&Request{OpCode: OPCODE_PING}, make(chan *Call, 1))
+		timer := time.NewTimer(c.keepAliveTimeout)
+
+		select {
+		case <-call.Done:
+		case <-timer.C:
+			call.Cancel()
+			c.dropConn()
+		case <-c.done:
+		}
+
+		timer.Stop()
+	}
+}
+
+// dropConn closes a connection whose server stopped answering pings.
+func (c *Client) dropConn() {
+	c.mu.Lock()
+	c.unresponsive = true
+	rwc := c.rwc
+	c.mu.Unlock()
+
+	rwc.Close()
+}
+
+func (c *Client) shouldReconnect(err error) bool {
+	if c.reconnect == nil || c.dial == nil || closeCodeForError(err) != 0 {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return !c.closing && !c.draining && c.peerClose == nil
+}
+
+// redial replaces a lost connection, reporting false if no new connection
+// could be established.
+func (c *Client) redial() bool {
+	c.rwc.Close()
+
+	if !c.reconnect.RetryPending {
+		c.mu.Lock()
+		failed := []*Call{}
+		for requestID, call := range c.pending {
+			delete(c.pending, requestID)
+			failed = append(failed, call)
+		}
+		c.mu.Unlock()
+
+		for _, call := range failed {
+			call.Error = ConnectionLost
+			call.done()
+		}
+	}
+
+	backoff := c.reconnect.MinBackoff
+	if backoff <= 0 {
+		backoff = DefaultMinBackoff
+	}
+
+	maxBackoff := c.reconnect.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+
+	for attempt := 1; c.reconnect.MaxAttempts == 0 || attempt <= c.reconnect.MaxAttempts; attempt++ {
+		rwc, err := c.dial()
+		if err == nil {
+			if !c.swap(rwc) {
+				rwc.Close()
+				return false
+			}
+
+			c.resume()
+			return true
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-c.quit:
+			return false
+		}
+
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+
+	return false
+}
+
+// swap installs rwc as the client's connection unless the client has been
+// closed in the meantime.
+func (c *Client) swap(rwc io.ReadWriteCloser) bool {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closing || c.draining {
+		return false
+	}
+
+	c.rwc = rwc
+	c.unresponsive = false
+
+	return true
+}
+
+// resume announces the session again and resends the pending calls on a new
+// connection.
+func (c *Client) resume() {
+	c.announceSession()
+
+	if !c.reconnect.RetryPending {
+		return
+	}
+
+	c.mu.Lock()
+	pending := []*Request{}
+	for _, call := range c.pending {
+		pending = append(pending, call.Request)
+	}
+	c.mu.Unlock()
+
+	for _, req := range pending {
+		if err := c.send(req); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package teaspoon
+
+import (
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+const handlerPanicMessage = "The handler failed to process the request"
+
+// Middleware wraps a Handler with behaviour that runs around it.
+type Middleware func(Handler) Handler
+
+// Chain composes middlewares into one. The first middleware is the outermost,
+// so it sees the request first and the reply last.
+func Chain(middlewares ...Middleware) Middleware {
+	return func(handler Handler) Handler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			handler = middlewares[i](handler)
+		}
+
+		return handler
+	}
+}
+
+// Recovery recovers from a panic in the handler, logs it with its stack to l
+// and answers the request with STATUS_INTERNAL_ERROR. A nil l logs to the
+// package logger.
+func Recovery(l *log.Logger) Middleware {
+	if l == nil {
+		l = logger
+	}
+
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Request) {
+			defer func() {
+				if err := recover(); err != nil {
+					l.Printf("Recovered handler panic for request %x: %v\n%s", r.RequestID, err, debug.Stack())
+					w.WriteError(STATUS_INTERNAL_ERROR, handlerPanicMessage)
+				}
+			}()
+
+			next.ServeTSP(w, r)
+		})
+	}
+}
+
+// Timing calls observe with the time the handler took for each request.
+func Timing(observe func(r *Request, elapsed time.Duration)) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Request) {
+			started := time.Now()
+			defer func() {
+				observe(r, time.Since(started))
+			}()
+
+			next.ServeTSP(w, r)
+		})
+	}
+}
+
+// Logging logs every request served with the time it took to l. A nil l logs
+// to the package logger.
+func Logging(l *log.Logger) Middleware {
+	if l == nil {
+		l = logger
+	}
+
+	return Timing(func(r *Request, elapsed time.Duration) {
+		l.Printf("Served method %d on resource %d for request %x in %s", r.Method, r.Resource, r.RequestID, elapsed)
+	})
+}
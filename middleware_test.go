@@ -0,0 +1,83 @@
+package teaspoon
+
+import (
+	"bytes"
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChain(t *testing.T) {
+	Convey("Chained middlewares should run outermost first", t, func() {
+		order := []string{}
+		trace := func(name string) Middleware {
+			return func(next Handler) Handler {
+				return HandlerFunc(func(w ResponseWriter, r *Request) {
+					order = append(order, name+" in")
+					next.ServeTSP(w, r)
+					order = append(order, name+" out")
+				})
+			}
+		}
+
+		handler := Chain(trace("A"), trace("B"))(HandlerFunc(func(w ResponseWriter, r *Request) {
+			order = append(order, "handler")
+		}))
+		handler.ServeTSP(nil, &Request{})
+
+		So(order, ShouldResemble, []string{"A in", "B in", "handler", "B out", "A out"})
+	})
+}
+
+func TestMiddlewares(t *testing.T) {
+	Convey("Recovery should answer a panicking handler with an internal error", t, func() {
+		out := &bytes.Buffer{}
+		handler := Chain(Recovery(log.New(out, "", 0)))(HandlerFunc(func(w ResponseWriter, r *Request) {
+			w.Write([]byte("PARTIAL"))
+			if string(r.Payload) == "PANIC" {
+				panic("BOOM")
+			}
+		}))
+
+		clientConn, serverConn := net.Pipe()
+		c := newConn(serverConn, &Server{Handler: handler})
+		go c.serve(context.Background())
+		client := NewClient(clientConn)
+		defer client.Close()
+
+		_, err := client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY, Payload: []byte("PANIC")})
+		So(err, ShouldHaveSameTypeAs, &ReplyError{})
+		So(err.(*ReplyError).Code, ShouldEqual, STATUS_INTERNAL_ERROR)
+
+		// The connection keeps serving requests.
+		reply, err := client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY})
+		So(err, ShouldBeNil)
+		So(reply.Payload, ShouldResemble, []byte("PARTIAL"))
+
+		client.Close()
+		<-c.done
+		So(out.String(), ShouldContainSubstring, "BOOM")
+		So(out.String(), ShouldContainSubstring, "middleware_test.go")
+	})
+
+	Convey("Timing and Logging should report every request", t, func() {
+		timings := []time.Duration{}
+		out := &bytes.Buffer{}
+		handler := Chain(
+			Timing(func(r *Request, elapsed time.Duration) { timings = append(timings, elapsed) }),
+			Logging(log.New(out, "", 0)),
+		)(HandlerFunc(func(w ResponseWriter, r *Request) {
+			time.Sleep(time.Millisecond * 5)
+		}))
+
+		handler.ServeTSP(nil, &Request{Method: 2, Resource: 7})
+
+		So(len(timings), ShouldEqual, 1)
+		So(timings[0], ShouldBeGreaterThanOrEqualTo, time.Millisecond*5)
+		So(strings.HasPrefix(out.String(), "Served method 2 on resource 7 for request "), ShouldBeTrue)
+	})
+}
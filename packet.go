@@ -5,14 +5,36 @@ import (
 	"io"
 )
 
+const (
+	DefaultMaxFrameSize = 1200
+
+	// MaxFramesPerRequest is the number of frames a request can be split
+	// into, as the header stores sequences in 16 bits.
+	MaxFramesPerRequest = 0xFFFF
+
+	// FLAG_FINAL marks the last frame of a request sent with a total
+	// sequence count of zero, whose length was not known when it started.
+	FLAG_FINAL = 0x1
+
+	// FLAG_ACK asks the receiver to acknowledge the request with an
+	// OPCODE_ACK frame carrying the same RequestID.
+	FLAG_ACK = 0x2
+
+	// FLAG_PUSH marks a message the server sends unprompted, as opposed to a
+	// reply to one of the client's requests.
+	FLAG_PUSH = 0x4
+)
+
 var (
-	PacketPayloadLengthExceeded = errors.New("The payload's packet length is too large")
+	PacketPayloadLengthExceeded  = errors.New("The payload's packet length is too large")
+	RequestPayloadLengthExceeded = errors.New("The request's payload length is too large")
 )
 
 type Packet struct {
 	opCode         byte
 	priority       byte
 	method         byte
+	flags          byte
 	resource       int
 	sequence       int32
 	totalSequences int32
@@ -40,22 +62,46 @@ func combinePacketPayloads(packets []*Packet) []byte {
 	return payload
 }
 
+// isLast reports whether packet completes its request.
+func (packet *Packet) isLast() bool {
+	if packet.totalSequences == 0 {
+		return packet.flags&FLAG_FINAL != 0
+	}
+
+	return packet.sequence == packet.totalSequences-1
+}
+
+// isSingle reports whether packet carries its whole request.
+func (packet *Packet) isSingle() bool {
+	return packet.sequence == 0 && packet.isLast()
+}
+
 func ReadPacket(r io.Reader) (*Packet, error) {
+	packet, err := readPacketHeader(r, DefaultMaxFrameSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := readPacketPayload(r, packet); err != nil {
+		return nil, err
+	}
+
+	return packet, nil
+}
+
+// readPacketHeader reads a packet's header, rejecting packets whose payload
+// would exceed maxFrameSize before any memory is allocated for it.
+func readPacketHeader(r io.Reader, maxFrameSize int) (*Packet, error) {
 	packet := new(Packet)
 	header := make([]byte, 28)
 
-	for total_bytes_read := 0; total_bytes_read < 28; {
-		bytes_read, err := r.Read(header)
-		// logger.Printf("ReadPacket - bytes read: %d", bytes_read)
-		if err != nil {
-			return nil, err
-		}
-
-		total_bytes_read += bytes_read
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
 	}
 
 	packet.opCode = (header[0] & 0xF0) >> 4
 	packet.priority = header[0] & 0x0F
+	packet.flags = (header[1] & 0xF0) >> 4
 	packet.method = header[1] & 0x0F
 	packet.resource = (int(header[2]) << 8) + int(header[3])
 	packet.sequence = (int32(header[4]) << 8) + int32(header[5])
@@ -66,21 +112,20 @@ func ReadPacket(r io.Reader) (*Packet, error) {
 
 	// logger.Printf("ReadPacket - payloadLength: %d", packet.payloadLength)
 
-	if packet.payloadLength > 1200 {
+	if uint64(packet.payloadLength) > uint64(maxFrameSize) {
 		return nil, PacketPayloadLengthExceeded
 	}
 
-	packet.payload = make([]byte, packet.payloadLength)
-	for total_bytes_read := uint32(0); total_bytes_read < packet.payloadLength; {
-		bytes_read, err := r.Read(packet.payload[total_bytes_read:])
-		if err != nil {
-			return nil, err
-		}
+	return packet, nil
+}
 
-		total_bytes_read += uint32(bytes_read)
+func readPacketPayload(r io.Reader, packet *Packet) error {
+	packet.payload = make([]byte, packet.payloadLength)
+	if _, err := io.ReadFull(r, packet.payload); err != nil {
+		return err
 	}
 
 	// logger.Printf("ReadPacket - generated packet: %v", packet)
 
-	return packet, nil
+	return nil
 }
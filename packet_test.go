@@ -5,6 +5,7 @@ import (
 	. "github.com/smartystreets/goconvey/convey"
 	"io"
 	"testing"
+	"testing/iotest"
 )
 
 func BenchmarkCombinePackets(b *testing.B) {
@@ -93,6 +94,32 @@ func TestReadPacket(t *testing.T) {
 		So(packet.payload, ShouldResemble, []byte{1})
 	})
 
+	Convey("A header delivered in several reads should result in a packet", t, func() {
+		valid_buffer := bytes.NewBuffer([]byte{
+			0x25, 0x04, 0x12, 0x34,
+			0x00, 0x00, 0x00, 0x01,
+			0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x01,
+			0x00, 0x00, 0x00, 0x02,
+			0x01, 0x02,
+		})
+
+		packet, err := ReadPacket(iotest.OneByteReader(valid_buffer))
+		So(err, ShouldBeNil)
+		So(packet.opCode, ShouldEqual, 2)
+		So(packet.resource, ShouldEqual, 0x1234)
+		So(packet.requestId, ShouldResemble, RequestID{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1})
+		So(packet.payload, ShouldResemble, []byte{1, 2})
+	})
+
+	Convey("A truncated header should result in an error", t, func() {
+		packet, err := ReadPacket(bytes.NewBuffer([]byte{0x25, 0x04, 0x12, 0x34}))
+		So(packet, ShouldBeNil)
+		So(err, ShouldEqual, io.ErrUnexpectedEOF)
+	})
+
 	Convey("A packet with a payload larger than 1200 bytes should return an error", t, func() {
 		valid_buffer := bytes.NewBuffer([]byte{
 			0x25, 0x04, 0x12, 0x34,
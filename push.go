@@ -0,0 +1,114 @@
+package teaspoon
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Conn is the server side of a client connection. It is available to
+// handlers through ResponseWriter.Conn, and the io.Writer handed to binders
+// is a Conn as well.
+type Conn interface {
+	// Write queues raw frames. Prefer Push, which frames the message itself.
+	io.Writer
+
+	// Push sends req to the client as an unsolicited message. A zero
+	// RequestID is replaced by a new one, and frames are queued with
+	// req.Priority like any reply.
+	Push(ctx context.Context, req *Request, opts ...PushOption) error
+
+	// Close closes the connection without a close handshake.
+	Close() error
+}
+
+type pushConfig struct {
+	ack bool
+}
+
+// PushOption configures a single call to Conn.Push.
+type PushOption func(*pushConfig)
+
+// WithAck makes Push wait until the client acknowledges the message. If the
+// client announced a session and Server.AckTimeout is set, the message is
+// sent again when the client reconnects with the same session, so it may be
+// delivered more than once. Push fails with an AckTimeoutError once
+// Server.AckTimeout elapses, with ctx.Err() once ctx is done, and with
+// ConnClosed if the connection closes and the message cannot be retransmitted.
+func WithAck() PushOption {
+	return func(config *pushConfig) {
+		config.ack = true
+	}
+}
+
+func (c *conn) Push(ctx context.Context, req *Request, opts ...PushOption) error {
+	config := pushConfig{}
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if req.RequestID == (RequestID{}) {
+		req.RequestID = NewRequestID()
+	}
+
+	pushed := *req
+	pushed.flags |= FLAG_PUSH
+	if !config.ack {
+		_, err := pushed.writeFrames(c, c.srv.maxFrameSize())
+		return err
+	}
+
+	pushed.flags |= FLAG_ACK
+
+	s := c.currentSession()
+	d := s.track(c.srv, &pushed)
+
+	// The client may announce a session while we wait, which takes the
+	// delivery along with it.
+	defer func() {
+		c.currentSession().forget(c.srv, pushed.RequestID)
+	}()
+
+	var timeout <-chan time.Time
+	if c.srv.AckTimeout > 0 {
+		timer := time.NewTimer(c.srv.AckTimeout)
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	// Only named sessions outlive their connection, and only a timeout
+	// stops them from waiting for a client that never returns.
+	var closed <-chan bool
+	if !s.named || timeout == nil {
+		closed = c.done
+	}
+
+	if err := s.send(d); err != nil && (closed != nil || err != ConnClosed) {
+		return err
+	}
+
+	select {
+	case <-d.acked:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timeout:
+		err := &AckTimeoutError{RequestID: pushed.RequestID}
+		c.reportError(err)
+		return err
+	case <-closed:
+		return ConnClosed
+	}
+}
+
+func (c *conn) currentSession() *session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.session
+}
@@ -0,0 +1,70 @@
+package teaspoon
+
+import (
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnPush(t *testing.T) {
+	Convey("A handler should be able to push messages and wait for them to be acknowledged", t, func() {
+		pushErrs := make(chan error, 1)
+		server := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+				pushErrs <- w.Conn().Push(r.Context(), &Request{OpCode: OPCODE_BINARY, Priority: 3, Payload: []byte("NEWS")}, WithAck())
+				w.Write([]byte("SUBSCRIBED"))
+			}),
+		}
+
+		pushes := make(chan *Request, 1)
+		clientConn, serverConn := net.Pipe()
+		go newConn(serverConn, server).serve(context.Background())
+		client := NewClient(clientConn, WithPushHandler(func(r *Request) { pushes <- r }))
+		defer client.Close()
+
+		reply, err := client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY, Payload: []byte("SUBSCRIBE")})
+		So(err, ShouldBeNil)
+		So(reply.Payload, ShouldResemble, []byte("SUBSCRIBED"))
+		So(<-pushErrs, ShouldBeNil)
+
+		push := <-pushes
+		So(push.RequestID, ShouldNotResemble, RequestID{})
+		So(push.Priority, ShouldEqual, 3)
+		So(push.Payload, ShouldResemble, []byte("NEWS"))
+	})
+
+	Convey("Waiting for an acknowledgement should end with the context", t, func() {
+		pushErrs := make(chan error, 1)
+		server := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+				ctx, cancel := context.WithTimeout(r.Context(), time.Millisecond*20)
+				defer cancel()
+
+				pushErrs <- w.Conn().Push(ctx, &Request{OpCode: OPCODE_BINARY}, WithAck())
+			}),
+		}
+
+		clientConn, serverConn := net.Pipe()
+		go newConn(serverConn, server).serve(context.Background())
+		client := NewClient(clientConn)
+		defer client.Close()
+
+		_, err := client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY})
+		So(err, ShouldBeNil)
+		So(<-pushErrs, ShouldEqual, context.DeadlineExceeded)
+	})
+
+	Convey("Pushes without an acknowledgement should return once queued", t, func() {
+		c := newConn(nil, &Server{})
+		req := &Request{OpCode: OPCODE_BINARY, Payload: []byte("HELLO")}
+
+		So(c.Push(context.Background(), req), ShouldBeNil)
+		So(req.RequestID, ShouldNotResemble, RequestID{})
+
+		frame, ok := c.frames.pop()
+		So(ok, ShouldBeTrue)
+		So(frame, ShouldResemble, req.frame(0, 1, FLAG_PUSH, req.Payload))
+	})
+}
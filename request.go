@@ -1,13 +1,23 @@
 package teaspoon
 
 import (
+	"context"
+	"crypto/rand"
 	"errors"
 	"io"
-	"sync"
 )
 
 type RequestID [16]byte
 
+func NewRequestID() RequestID {
+	requestID := RequestID{}
+	if _, err := rand.Read(requestID[:]); err != nil {
+		panic(err)
+	}
+
+	return requestID
+}
+
 type Request struct {
 	OpCode    byte
 	Priority  byte
@@ -15,6 +25,36 @@ type Request struct {
 	Resource  int
 	RequestID RequestID
 	Payload   []byte
+
+	// Body is set on requests received by a server with StreamRequests
+	// enabled and yields the payload as its frames arrive.
+	Body io.ReadCloser
+
+	flags byte
+	ctx   context.Context
+}
+
+// Context returns the request's context. On the server it is cancelled when
+// the client disconnects, the server stops or Server.RequestTimeout elapses.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of r with its context changed to ctx.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("teaspoon: nil context")
+	}
+
+	r2 := new(Request)
+	*r2 = *r
+	r2.ctx = ctx
+
+	return r2
 }
 
 func (r *Request) GetFrames(frameSize int32) [][]byte {
@@ -29,22 +69,36 @@ func (r *Request) GetFrames(frameSize int32) [][]byte {
 			payloadLength = int32(len(payload)) - sequence*frameSize
 		}
 
-		frame := []byte{
-			(r.OpCode << 4) | r.Priority, r.Method, byte(r.Resource >> 8), byte(r.Resource),
-			byte(sequence >> 8), byte(sequence), byte(totalSequences >> 8), byte(totalSequences),
-		}
-		frame = append(frame, r.RequestID[:]...)
-		frame = append(frame, []byte{byte(payloadLength >> 24), byte(payloadLength >> 16), byte(payloadLength >> 8), byte(payloadLength)}...)
-		frame = append(frame, payload[sequence*frameSize:sequence*frameSize+payloadLength]...)
-
-		frames = append(frames, frame)
+		frames = append(frames, r.frame(sequence, totalSequences, 0, payload[sequence*frameSize:sequence*frameSize+payloadLength]))
 	}
 
 	return frames
 }
 
+func (r *Request) frame(sequence int32, totalSequences int32, flags byte, payload []byte) []byte {
+	payloadLength := len(payload)
+
+	frame := []byte{
+		(r.OpCode << 4) | r.Priority, ((flags | r.flags) << 4) | r.Method, byte(r.Resource >> 8), byte(r.Resource),
+		byte(sequence >> 8), byte(sequence), byte(totalSequences >> 8), byte(totalSequences),
+	}
+	frame = append(frame, r.RequestID[:]...)
+	frame = append(frame, []byte{byte(payloadLength >> 24), byte(payloadLength >> 16), byte(payloadLength >> 8), byte(payloadLength)}...)
+	frame = append(frame, payload...)
+
+	return frame
+}
+
 func (r *Request) WriteTo(w io.Writer) (n int64, err error) {
-	for _, frame := range r.GetFrames(1200) {
+	return r.writeFrames(w, DefaultMaxFrameSize)
+}
+
+func (r *Request) writeFrames(w io.Writer, frameSize int) (n int64, err error) {
+	if len(r.Payload)/frameSize+1 > MaxFramesPerRequest {
+		return 0, RequestPayloadLengthExceeded
+	}
+
+	for _, frame := range r.GetFrames(int32(frameSize)) {
 		bw, err := w.Write(frame)
 		n += int64(bw)
 		if err != nil {
@@ -55,13 +109,11 @@ func (r *Request) WriteTo(w io.Writer) (n int64, err error) {
 	return n, err
 }
 
-var readerPackets map[io.Reader](map[RequestID][]*Packet)
-var readerPacketsMutex = sync.Mutex{}
-
 var (
 	InvalidPacketSequence = errors.New("Invalid sequence of packets provided")
 	InvalidRequestId      = errors.New("Invalid request ID provided")
 	RequestNotReady       = errors.New("The packets for the request ID are not ready yet")
+	InterleavedRequest    = errors.New("A frame of another request was read before the request was complete")
 )
 
 func constructRequest(packets []*Packet) (*Request, error) {
@@ -80,39 +132,31 @@ func constructRequest(packets []*Packet) (*Request, error) {
 		Resource:  packets[0].resource,
 		RequestID: packets[0].requestId,
 		Payload:   combinePacketPayloads(packets),
+		flags:     packets[0].flags &^ FLAG_FINAL,
 	}, nil
 }
 
+// ReadRequest reads a single request from r. It fails with
+// InterleavedRequest if a frame of another request arrives before the
+// request is complete.
+//
+// Deprecated: ReadRequest only supports streams that do not multiplex
+// requests. Use a Decoder to read every request on a stream.
 func ReadRequest(r io.Reader) (*Request, error) {
-	readerPacketsMutex.Lock()
-	if readerPackets == nil {
-		readerPackets = make(map[io.Reader]map[RequestID][]*Packet)
-	}
-	readerPacketsMutex.Unlock()
+	d := NewDecoder(r)
 
 	for {
-		packet, err := ReadPacket(r)
+		packet, err := d.readPacket(r)
 		if err != nil {
 			return nil, err
 		}
 
-		readerPacketsMutex.Lock()
-		if readerPackets[r] == nil {
-			readerPackets[r] = make(map[RequestID][]*Packet)
+		if len(d.partials) > 0 && d.partials[packet.requestId] == nil {
+			return nil, InterleavedRequest
 		}
 
-		readerPackets[r][packet.requestId] = append(readerPackets[r][packet.requestId], packet)
-
-		if packet.sequence == packet.totalSequences-1 {
-			request, err := constructRequest(readerPackets[r][packet.requestId])
-			delete(readerPackets[r], packet.requestId)
-			readerPacketsMutex.Unlock()
-
+		if request, complete, err := d.add(packet); complete || err != nil {
 			return request, err
 		}
-
-		readerPacketsMutex.Unlock()
 	}
-
-	return nil, io.EOF
 }
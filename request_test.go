@@ -107,6 +107,17 @@ func TestReadRequest(t *testing.T) {
 		So(request.RequestID, ShouldResemble, RequestID{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 2})
 		So(request.Payload, ShouldResemble, []byte{1, 2, 3})
 	})
+
+	Convey("A frame of another request read before the request is complete should be an error", t, func() {
+		first := &Request{OpCode: OPCODE_BINARY, RequestID: RequestID{1}, Payload: []byte("HELLO WORLD")}
+		second := &Request{OpCode: OPCODE_BINARY, RequestID: RequestID{2}, Payload: []byte("BYE")}
+
+		firstFrames := first.GetFrames(5)
+		buffer := bytes.NewBuffer(bytes.Join([][]byte{firstFrames[0], second.GetFrames(5)[0], firstFrames[1], firstFrames[2]}, nil))
+
+		_, err := ReadRequest(buffer)
+		So(err, ShouldEqual, InterleavedRequest)
+	})
 }
 
 func TestRequestGetFrames(t *testing.T) {
@@ -165,3 +176,13 @@ func TestRequestGetFrames(t *testing.T) {
 		}, request.Payload[5:]...))
 	})
 }
+
+func TestRequestWriteFrames(t *testing.T) {
+	Convey("A request needing more frames than the header can express should not be written", t, func() {
+		large := &Request{OpCode: OPCODE_BINARY, Payload: make([]byte, MaxFramesPerRequest)}
+
+		n, err := large.writeFrames(bytes.NewBuffer([]byte{}), 1)
+		So(n, ShouldEqual, 0)
+		So(err, ShouldEqual, RequestPayloadLengthExceeded)
+	})
+}
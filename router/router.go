@@ -7,38 +7,108 @@ import (
 )
 
 func NotFound(w teaspoon.ResponseWriter, r *teaspoon.Request) {
-	fmt.Println("NOT FOUND!!")
+	w.WriteError(teaspoon.STATUS_NOT_FOUND, fmt.Sprintf("No handler for resource %d", r.Resource))
+}
+
+func MethodNotAllowed(w teaspoon.ResponseWriter, r *teaspoon.Request) {
+	w.WriteError(teaspoon.STATUS_METHOD_NOT_ALLOWED, fmt.Sprintf("No handler for method %d on resource %d", r.Method, r.Resource))
+}
+
+// route holds the handlers registered for a resource. any serves the
+// methods without a handler of their own.
+type route struct {
+	methods map[byte]teaspoon.Handler
+	any     teaspoon.Handler
+}
+
+func (rt *route) handler(method byte) (teaspoon.Handler, bool) {
+	if handler, ok := rt.methods[method]; ok {
+		return handler, true
+	}
+
+	return rt.any, rt.any != nil
 }
 
 type Router struct {
-	handlers map[int]teaspoon.Handler
-	mu       sync.RWMutex
-	notFound teaspoon.Handler
+	routes           map[int]*route
+	mu               sync.RWMutex
+	notFound         teaspoon.Handler
+	methodNotAllowed teaspoon.Handler
+	middlewares      []teaspoon.Middleware
+}
+
+func (router *Router) route(resource int) *route {
+	if router.routes == nil {
+		router.routes = make(map[int]*route)
+	}
+
+	rt, ok := router.routes[resource]
+	if !ok {
+		rt = &route{methods: make(map[byte]teaspoon.Handler)}
+		router.routes[resource] = rt
+	}
+
+	return rt
 }
 
-func (router *Router) Handle(resource int, handler teaspoon.Handler) {
+// Use adds middlewares that wrap every request the router serves, including
+// those answered by the not found and method not allowed handlers.
+func (router *Router) Use(middlewares ...teaspoon.Middleware) {
 	router.mu.Lock()
 	defer router.mu.Unlock()
 
-	if router.handlers == nil {
-		router.handlers = make(map[int]teaspoon.Handler)
-	}
+	router.middlewares = append(router.middlewares, middlewares...)
+}
+
+// Handle registers handler for requests with the given method on resource.
+// The middlewares wrap this handler only, inside those added with Use.
+func (router *Router) Handle(method byte, resource int, handler teaspoon.Handler, middlewares ...teaspoon.Middleware) {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	router.route(resource).methods[method] = teaspoon.Chain(middlewares...)(handler)
+}
+
+func (router *Router) HandleFunc(method byte, resource int, handlerFunc func(teaspoon.ResponseWriter, *teaspoon.Request), middlewares ...teaspoon.Middleware) {
+	router.Handle(method, resource, teaspoon.HandlerFunc(handlerFunc), middlewares...)
+}
+
+// HandleAny registers handler for requests on resource whose method has no
+// handler registered with Handle.
+func (router *Router) HandleAny(resource int, handler teaspoon.Handler, middlewares ...teaspoon.Middleware) {
+	router.mu.Lock()
+	defer router.mu.Unlock()
 
-	router.handlers[resource] = handler
+	router.route(resource).any = teaspoon.Chain(middlewares...)(handler)
 }
 
-func (router *Router) HandleFunc(resource int, handlerFunc func(teaspoon.ResponseWriter, *teaspoon.Request)) {
-	router.Handle(resource, teaspoon.HandlerFunc(handlerFunc))
+func (router *Router) HandleAnyFunc(resource int, handlerFunc func(teaspoon.ResponseWriter, *teaspoon.Request), middlewares ...teaspoon.Middleware) {
+	router.HandleAny(resource, teaspoon.HandlerFunc(handlerFunc), middlewares...)
+}
+
+// SetMethodNotAllowed sets the handler for requests on a known resource with
+// a method that has no handler. The default is MethodNotAllowed.
+func (router *Router) SetMethodNotAllowed(handler teaspoon.Handler) {
+	if handler == nil {
+		handler = teaspoon.HandlerFunc(MethodNotAllowed)
+	}
+
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	router.methodNotAllowed = handler
 }
 
 func (router *Router) ServeTSP(w teaspoon.ResponseWriter, r *teaspoon.Request) {
 	router.mu.RLock()
-	defer router.mu.RUnlock()
-
-	handler, ok := router.handlers[r.Resource]
-	if !ok {
-		handler = router.notFound
+	handler := router.notFound
+	if rt, ok := router.routes[r.Resource]; ok {
+		if handler, ok = rt.handler(r.Method); !ok {
+			handler = router.methodNotAllowed
+		}
 	}
+	handler = teaspoon.Chain(router.middlewares...)(handler)
+	router.mu.RUnlock()
 
 	handler.ServeTSP(w, r)
 }
@@ -48,5 +118,5 @@ func NewRouter(notFound teaspoon.Handler) *Router {
 		notFound = teaspoon.HandlerFunc(NotFound)
 	}
 
-	return &Router{notFound: notFound}
+	return &Router{notFound: notFound, methodNotAllowed: teaspoon.HandlerFunc(MethodNotAllowed)}
 }
@@ -0,0 +1,93 @@
+package router
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/teltechsystems/teaspoon"
+	"io"
+	"testing"
+)
+
+type recordingWriter struct {
+	bytes.Buffer
+	code int
+}
+
+func (w *recordingWriter) SetMethod(byte)             {}
+func (w *recordingWriter) SetResource(int)            {}
+func (w *recordingWriter) GetDirectWriter() io.Writer { return w }
+func (w *recordingWriter) Conn() teaspoon.Conn        { return nil }
+
+func (w *recordingWriter) WriteError(code int, message string) {
+	w.code = code
+	w.Reset()
+	w.WriteString(message)
+}
+
+func reply(body string) func(teaspoon.ResponseWriter, *teaspoon.Request) {
+	return func(w teaspoon.ResponseWriter, r *teaspoon.Request) {
+		w.Write([]byte(body))
+	}
+}
+
+func TestRouterMethods(t *testing.T) {
+	Convey("Requests should be routed by method and resource", t, func() {
+		router := NewRouter(nil)
+		router.HandleFunc(1, 10, reply("GET"))
+		router.HandleFunc(2, 10, reply("SET"))
+		router.HandleAnyFunc(20, reply("ANY"))
+		router.HandleFunc(2, 20, reply("SET20"))
+
+		serve := func(method byte, resource int) *recordingWriter {
+			w := &recordingWriter{}
+			router.ServeTSP(w, &teaspoon.Request{Method: method, Resource: resource})
+			return w
+		}
+
+		So(serve(1, 10).String(), ShouldEqual, "GET")
+		So(serve(2, 10).String(), ShouldEqual, "SET")
+		So(serve(1, 20).String(), ShouldEqual, "ANY")
+		So(serve(2, 20).String(), ShouldEqual, "SET20")
+
+		w := serve(3, 10)
+		So(w.code, ShouldEqual, teaspoon.STATUS_METHOD_NOT_ALLOWED)
+		So(w.String(), ShouldEqual, "No handler for method 3 on resource 10")
+
+		w = serve(1, 30)
+		So(w.code, ShouldEqual, teaspoon.STATUS_NOT_FOUND)
+		So(w.String(), ShouldEqual, "No handler for resource 30")
+
+		router.SetMethodNotAllowed(teaspoon.HandlerFunc(reply("CUSTOM")))
+		So(serve(3, 10).String(), ShouldEqual, "CUSTOM")
+	})
+}
+
+func TestRouterUse(t *testing.T) {
+	Convey("Router middlewares should wrap every request and route middlewares their route", t, func() {
+		order := []string{}
+		trace := func(name string) teaspoon.Middleware {
+			return func(next teaspoon.Handler) teaspoon.Handler {
+				return teaspoon.HandlerFunc(func(w teaspoon.ResponseWriter, r *teaspoon.Request) {
+					order = append(order, name)
+					next.ServeTSP(w, r)
+				})
+			}
+		}
+
+		router := NewRouter(nil)
+		router.Use(trace("global"))
+		router.HandleFunc(1, 10, reply("GET"), trace("route"))
+		router.HandleFunc(2, 10, reply("SET"))
+
+		router.ServeTSP(&recordingWriter{}, &teaspoon.Request{Method: 1, Resource: 10})
+		So(order, ShouldResemble, []string{"global", "route"})
+
+		order = nil
+		router.ServeTSP(&recordingWriter{}, &teaspoon.Request{Method: 2, Resource: 10})
+		So(order, ShouldResemble, []string{"global"})
+
+		order = nil
+		router.ServeTSP(&recordingWriter{}, &teaspoon.Request{Method: 1, Resource: 30})
+		So(order, ShouldResemble, []string{"global"})
+	})
+}
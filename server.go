@@ -2,30 +2,65 @@ package teaspoon
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	OPCODE_CONTINUATION = 0x0
 	OPCODE_TEXT         = 0x1
 	OPCODE_BINARY       = 0x2
+	OPCODE_ERROR        = 0x3
 	OPCODE_CLOSE        = 0x8
 	OPCODE_PING         = 0x9
 	OPCODE_PONG         = 0xA
+	OPCODE_ACK          = 0xB
+	OPCODE_SESSION      = 0xC
 	CLIENT_CONNECT      = 1
 	CLIENT_DISCONNECT   = 2
 )
 
 var (
 	logger = log.New(os.Stdout, "[teaspoon] ", 0)
+
+	// responseBuffers holds the buffers replies are written into. Each
+	// response takes its own, since handlers on a connection run concurrently.
+	responseBuffers = sync.Pool{
+		New: func() interface{} {
+			return &bytes.Buffer{}
+		},
+	}
 )
 
+// maxPooledResponseBuffer is the largest buffer returned to responseBuffers,
+// so that one large reply does not pin its memory for the server's lifetime.
+const maxPooledResponseBuffer = 64 << 10
+
+var (
+	ServerClosed = errors.New("The server has been closed")
+	ConnClosed   = errors.New("The client has disconnected")
+)
+
+// ReassemblyTimeoutError is reported to Server.ErrorHook when a multi-frame
+// request is not received in full within Server.ReassemblyTimeout.
+type ReassemblyTimeoutError struct {
+	RequestID RequestID
+}
+
+func (e *ReassemblyTimeoutError) Error() string {
+	return fmt.Sprintf("Request %x was not received in full before the reassembly timeout", e.RequestID[:])
+}
+
 type Handler interface {
 	ServeTSP(ResponseWriter, *Request)
 }
@@ -39,14 +74,110 @@ func (f HandlerFunc) ServeTSP(w ResponseWriter, r *Request) {
 type ResponseWriter interface {
 	SetMethod(byte)
 	SetResource(int)
+
+	// GetDirectWriter returns the connection for writing raw frames.
+	//
+	// Deprecated: use Conn().Push instead.
 	GetDirectWriter() io.Writer
+
+	// Conn returns the connection the request arrived on, which can be used
+	// to push messages to the client.
+	Conn() Conn
+
 	Write([]byte) (int, error)
+
+	// WriteError turns the reply into an error reply with one of the
+	// STATUS_ codes, discarding anything written so far. If part of the
+	// reply has already been flushed, the client discards it and receives
+	// the error instead.
+	WriteError(code int, message string)
+}
+
+// Flusher is implemented by ResponseWriters that can send a reply
+// incrementally. Once Flush has been called the written data is sent in
+// frames as it accumulates. A later WriteError cuts the flushed reply short
+// with an error reply, which replaces it on the client.
+type Flusher interface {
+	Flush() error
 }
 
 type Server struct {
 	Addr    string
 	Handler Handler
+
+	// RequestTimeout, when non-zero, sets a deadline on the context of every
+	// request passed to Handler.
+	RequestTimeout time.Duration
+
+	// ReadTimeout is the maximum duration for reading a frame once its first
+	// byte has arrived.
+	ReadTimeout time.Duration
+
+	// WriteTimeout is the maximum duration for writing a single frame.
+	WriteTimeout time.Duration
+
+	// IdleTimeout is how long a connection may wait for the next frame while
+	// none of its requests are being handled.
+	IdleTimeout time.Duration
+
+	// ReassemblyTimeout limits how long the frames of a multi-frame request
+	// may take to arrive. Incomplete requests are discarded once it elapses.
+	ReassemblyTimeout time.Duration
+
+	// MaxFrameSize is the largest frame payload accepted from clients and
+	// the size replies are split into. Zero means DefaultMaxFrameSize.
+	MaxFrameSize int
+
+	// MaxRequestBytes limits the total payload of a request. Clients sending
+	// larger requests are disconnected with CLOSE_TOO_LARGE. Zero means no
+	// limit.
+	MaxRequestBytes int64
+
+	// MaxOpenRequests limits how many requests a client may have partially
+	// sent at once. Clients exceeding it are disconnected with
+	// CLOSE_POLICY_VIOLATION. Zero means DefaultMaxOpenRequests.
+	MaxOpenRequests int
+
+	// StreamRequests makes the server invoke Handler as soon as the first
+	// frame of a request arrives, which must be its first sequence. The
+	// payload is then read from Request.Body in sequence order and
+	// Request.Payload is left empty. Control frames such as OPCODE_CLOSE and
+	// OPCODE_SESSION keep their Payload. Streams count against
+	// MaxOpenRequests and expire after ReassemblyTimeout like any other
+	// partially received request. Frames of a request still waiting for a
+	// Dispatcher worker are buffered, up to MaxRequestBytes, and so are the
+	// requests waiting for one, up to MaxOpenRequests.
+	StreamRequests bool
+
+	// AckTimeout bounds how long Conn.Push waits for a message sent WithAck
+	// to be acknowledged. While it runs, messages to clients that announced
+	// a session are kept and retransmitted when the client reconnects.
+	AckTimeout time.Duration
+
+	// Dispatcher, when set, runs handlers on bounded worker pools. Without
+	// one every request is handled in its own goroutine.
+	Dispatcher *Dispatcher
+
+	// ErrorHook, when set, is called with errors that occur on a connection,
+	// such as timeouts and expired requests.
+	ErrorHook func(c io.Writer, err error)
+
+	// ErrorLog, when set, receives the stack of handlers that panicked.
+	// Otherwise the package logger is used.
+	ErrorLog *log.Logger
+
 	binders []Binder
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	activeConn map[*conn]struct{}
+	sessions   map[SessionID]*session
+	inShutdown bool
+
+	// baseCtx is the parent of every connection's context. It is only
+	// cancelled by Close, or by Shutdown once in-flight handlers are done.
+	baseCtx    context.Context
+	cancelBase context.CancelFunc
 }
 
 func (srv *Server) AddBinder(b Binder) {
@@ -54,6 +185,10 @@ func (srv *Server) AddBinder(b Binder) {
 }
 
 func (srv *Server) ListenAndServe() error {
+	if srv.shuttingDown() {
+		return ServerClosed
+	}
+
 	addr := srv.Addr
 	if addr == "" {
 		addr = ":http"
@@ -66,37 +201,211 @@ func (srv *Server) ListenAndServe() error {
 }
 
 func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(l, true) {
+		l.Close()
+		return ServerClosed
+	}
+	defer s.trackListener(l, false)
 	defer l.Close()
 
+	ctx := s.baseContext()
+
 	for {
 		rwc, err := l.Accept()
 		if err != nil {
+			if s.shuttingDown() {
+				return ServerClosed
+			}
+
 			return err
 		}
 
-		go func() {
-			conn := &conn{
-				rwc:       rwc,
-				srv:       s,
-				frameChan: make(chan []byte, 10),
-				quitChan:  make(chan bool),
-				mu:        &sync.Mutex{},
-				buffer:    bytes.NewBuffer([]byte{}),
-			}
-			conn.serve()
-		}()
+		c := newConn(rwc, s)
+		if !s.trackConn(c, true) {
+			rwc.Close()
+			return ServerClosed
+		}
+
+		go c.serve(ctx)
 	}
+}
 
-	return nil
+func (s *Server) baseContext() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.baseCtx == nil {
+		s.baseCtx, s.cancelBase = context.WithCancel(context.Background())
+	}
+
+	return s.baseCtx
+}
+
+func (s *Server) cancelBaseContext() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancelBase != nil {
+		s.cancelBase()
+	}
 }
 
-func (s *Server) triggerEvent(eventType int, c io.Writer) {
+func (s *Server) errorLog() *log.Logger {
+	if s.ErrorLog != nil {
+		return s.ErrorLog
+	}
+
+	return logger
+}
+
+func (s *Server) maxFrameSize() int {
+	if s.MaxFrameSize > 0 {
+		return s.MaxFrameSize
+	}
+
+	return DefaultMaxFrameSize
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.inShutdown
+}
+
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+
+	if add {
+		if s.inShutdown {
+			return false
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+
+	return true
+}
+
+// trackConn adds or removes c from the active connections. Adding fails
+// once the server has started shutting down.
+func (s *Server) trackConn(c *conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.activeConn == nil {
+		s.activeConn = make(map[*conn]struct{})
+	}
+
+	if add {
+		if s.inShutdown {
+			return false
+		}
+		s.activeConn[c] = struct{}{}
+	} else {
+		delete(s.activeConn, c)
+	}
+
+	return true
+}
+
+// beginClose stops the server from accepting new connections and returns
+// the connections that are still active.
+func (s *Server) beginClose() ([]*conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inShutdown = true
+
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.listeners, l)
+	}
+
+	conns := make([]*conn, 0, len(s.activeConn))
+	for c := range s.activeConn {
+		conns = append(conns, c)
+	}
+
+	return conns, err
+}
+
+// Shutdown gracefully stops the server. It closes all listeners, sends a
+// close frame to every client, waits for in-flight handlers to send their
+// replies and then closes the connections. If ctx expires first, Shutdown
+// returns the context's error and the remaining connections are left to
+// finish on their own.
+func (s *Server) Shutdown(ctx context.Context) error {
+	conns, err := s.beginClose()
+
+	for _, c := range conns {
+		c.beginShutdown()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for _, c := range conns {
+			c.handlers.Wait()
+			c.flush()
+			<-c.done
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.cancelBaseContext()
+		if s.Dispatcher != nil {
+			s.Dispatcher.close()
+		}
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close immediately closes all listeners and connections without waiting
+// for in-flight handlers.
+func (s *Server) Close() error {
+	conns, err := s.beginClose()
+
+	for _, c := range conns {
+		c.quit()
+	}
+
+	s.cancelBaseContext()
+
+	if s.Dispatcher != nil {
+		s.Dispatcher.close()
+	}
+
+	return err
+}
+
+func (s *Server) triggerEvent(eventType int, c io.Writer, reason CloseReason) {
 	for i := range s.binders {
 		switch eventType {
 		case CLIENT_CONNECT:
 			s.binders[i].OnClientConnect(c)
 		case CLIENT_DISCONNECT:
-			s.binders[i].OnClientDisconnect(c)
+			s.binders[i].OnClientDisconnect(c, reason)
+		}
+	}
+}
+
+func (s *Server) triggerPong(c io.Writer, r *Request) {
+	for i := range s.binders {
+		if b, ok := s.binders[i].(PongBinder); ok {
+			b.OnPong(c, r)
 		}
 	}
 }
@@ -111,12 +420,23 @@ type response struct {
 	req   *Request
 	reply *Request
 	w     *bytes.Buffer
+
+	streaming bool
+	sequence  int32
+
+	// aborted is set when WriteError is called on a streamed reply. The
+	// stream is then ended with an error reply instead of a final frame.
+	aborted bool
 }
 
 func (r *response) GetDirectWriter() io.Writer {
 	return r.conn
 }
 
+func (r *response) Conn() Conn {
+	return r.conn
+}
+
 func (r *response) SetMethod(method byte) {
 	logger.Println("Setting method", method)
 	r.reply.Method = method
@@ -127,71 +447,549 @@ func (r *response) SetResource(resource int) {
 }
 
 func (r *response) Write(p []byte) (int, error) {
-	return r.w.Write(p)
+	n, err := r.w.Write(p)
+	if err != nil || !r.streaming || r.aborted {
+		return n, err
+	}
+
+	return n, r.sendStreamed(false, false)
+}
+
+// Flush sends everything written so far, switching the reply to frames with
+// a total sequence count of zero that are completed by a FLAG_FINAL frame.
+func (r *response) Flush() error {
+	if r.aborted {
+		return nil
+	}
+
+	r.streaming = true
+
+	return r.sendStreamed(true, false)
+}
+
+// sendStreamed sends the buffered payload of a streamed reply. A partial
+// frame is held back for more data unless flush is set, and final sends the
+// last frame even if it is empty.
+func (r *response) sendStreamed(flush bool, final bool) error {
+	frameSize := r.conn.srv.maxFrameSize()
+
+	r.reply.RequestID = r.req.RequestID
+	r.reply.Priority = r.req.Priority
+
+	for {
+		buffered := r.w.Len()
+		if !final && (buffered == 0 || buffered < frameSize && !flush) {
+			return nil
+		}
+
+		if r.sequence >= MaxFramesPerRequest {
+			return RequestPayloadLengthExceeded
+		}
+
+		payload := r.w.Next(frameSize)
+		last := final && r.w.Len() == 0
+
+		flags := byte(0)
+		if last {
+			flags = FLAG_FINAL
+		}
+
+		if _, err := r.conn.Write(r.reply.frame(r.sequence, 0, flags, payload)); err != nil {
+			return err
+		}
+		r.sequence++
+
+		if last {
+			return nil
+		}
+	}
+}
+
+func (r *response) WriteError(code int, message string) {
+	if r.streaming {
+		r.aborted = true
+	}
+
+	r.reply.OpCode = OPCODE_ERROR
+	r.w.Reset()
+	r.w.Write(statusPayload(code, message))
 }
 
 func (r *response) finishRequest() {
+	defer r.releaseBuffer()
+
+	if r.streaming && !r.aborted {
+		if err := r.sendStreamed(true, true); err != nil && err != ConnClosed {
+			r.conn.reportError(err)
+		}
+		return
+	}
+
 	r.reply.RequestID = r.req.RequestID
 	r.reply.Priority = r.req.Priority
 	r.reply.Payload = r.w.Bytes()
-	r.reply.WriteTo(r.conn)
+
+	if _, err := r.reply.writeFrames(r.conn, r.conn.srv.maxFrameSize()); err != nil && err != ConnClosed {
+		r.conn.reportError(err)
+	}
+}
+
+// releaseBuffer returns the reply buffer to responseBuffers once the reply
+// has been written. The frames sent hold copies of the payload.
+func (r *response) releaseBuffer() {
+	if r.w.Cap() <= maxPooledResponseBuffer {
+		r.w.Reset()
+		responseBuffers.Put(r.w)
+	}
+	r.w = nil
 }
 
 type conn struct {
 	rwc       io.ReadWriteCloser
 	srv       *Server
-	frameChan chan []byte
+	ctx       context.Context
+	cancel    context.CancelFunc
+	frames    *frameQueue
+	slots     chan bool
+	flushChan chan bool
+	flushOnce sync.Once
 	quitChan  chan bool
+	quitOnce  sync.Once
+	done      chan bool
+	handlers  sync.WaitGroup
+	inFlight  int32
+	draining  bool
 	closed    bool
 	mu        *sync.Mutex
-	buffer    *bytes.Buffer
+	decoder   *Decoder
+	streams   map[RequestID]*stream
+	session   *session
+
+	// queued counts the streamed requests waiting for a worker of the
+	// Dispatcher, which they do off the reader so it can feed the running
+	// handlers.
+	queued int32
+
+	closeSent   bool
+	closeReason CloseReason
 }
 
-func (c *conn) readRequest(r io.Reader) (*response, error) {
-	req, err := ReadRequest(r)
-	if err != nil {
-		readerPacketsMutex.Lock()
+func newConn(rwc io.ReadWriteCloser, srv *Server) *conn {
+	var slots chan bool
+	if srv != nil && srv.Dispatcher != nil && srv.Dispatcher.MaxInFlightPerConn > 0 {
+		slots = make(chan bool, srv.Dispatcher.MaxInFlightPerConn)
+	}
 
-		for k, _ := range readerPackets[r] {
-			delete(readerPackets[r], k)
-		}
-		delete(readerPackets, r)
+	c := &conn{
+		rwc:       rwc,
+		srv:       srv,
+		frames:    newFrameQueue(10),
+		slots:     slots,
+		flushChan: make(chan bool),
+		quitChan:  make(chan bool),
+		done:      make(chan bool),
+		mu:        &sync.Mutex{},
+		streams:   make(map[RequestID]*stream),
 
-		readerPacketsMutex.Unlock()
+		closeReason: CloseReason{Code: CLOSE_ABNORMAL},
+	}
+	c.session = newSession(c)
 
-		return nil, err
+	c.decoder = NewDecoder(rwc)
+	if srv != nil {
+		c.decoder.MaxFrameSize = srv.MaxFrameSize
+		c.decoder.MaxRequestBytes = srv.MaxRequestBytes
+		c.decoder.MaxOpenRequests = srv.MaxOpenRequests
 	}
 
-	c.buffer.Reset()
+	return c
+}
+
+// isControl reports whether opCode is handled by the connection itself
+// rather than passed on to Handler.
+func isControl(opCode byte) bool {
+	return opCode >= OPCODE_CLOSE
+}
+
+func (c *conn) readRequest() (*response, error) {
+	var req *Request
+
+	for {
+		packet, err := c.readPacket()
+		if err != nil {
+			return nil, err
+		}
+
+		if c.srv.StreamRequests && !isControl(packet.opCode) {
+			request, err := c.streamPacket(packet)
+			if err != nil {
+				return nil, err
+			}
+
+			if request == nil {
+				continue
+			}
+
+			req = request
+			break
+		}
+
+		request, complete, err := c.decoder.add(packet)
+		if err != nil {
+			return nil, err
+		}
+
+		if complete {
+			req = request
+			break
+		}
+	}
 
 	return &response{
 		conn:  c,
 		req:   req,
 		reply: &Request{OpCode: OPCODE_BINARY, Method: 0x01, Resource: 0x00},
-		w:     c.buffer,
+		w:     responseBuffers.Get().(*bytes.Buffer),
 	}, nil
 }
 
+// Write queues p to be sent to the client. Each call must carry whole frames:
+// queued frames are sent by priority, so writes may be reordered.
 func (c *conn) Write(p []byte) (int, error) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	closed := c.closed
+	c.mu.Unlock()
 
-	if c.closed {
-		return 0, errors.New("The client has disconnected")
+	if closed {
+		return 0, ConnClosed
 	}
 
-	c.frameChan <- p
+	if err := c.frames.push(p, c.done); err != nil {
+		return 0, err
+	}
 
 	return len(p), nil
 }
 
-func (c *conn) serve() {
-	c.srv.triggerEvent(CLIENT_CONNECT, c)
+type deadlineSetter interface {
+	SetReadDeadline(time.Time) error
+	SetWriteDeadline(time.Time) error
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// readPacket reads the next frame from r. While waiting for a frame to start
+// the read deadline enforces IdleTimeout and ReassemblyTimeout; once it has
+// started the rest of the frame must arrive within ReadTimeout.
+func (c *conn) readPacket() (*Packet, error) {
+	deadlines, _ := c.rwc.(deadlineSetter)
+	if deadlines == nil || (c.srv.ReadTimeout <= 0 && c.srv.IdleTimeout <= 0 && c.srv.ReassemblyTimeout <= 0) {
+		return c.decoder.readPacket(c.rwc)
+	}
+
+	idleDeadline := time.Time{}
+	if c.srv.IdleTimeout > 0 {
+		idleDeadline = time.Now().Add(c.srv.IdleTimeout)
+	}
+
+	first := make([]byte, 1)
+	for {
+		deadlines.SetReadDeadline(c.nextReadDeadline(idleDeadline))
+
+		_, err := io.ReadFull(c.rwc, first)
+		if err == nil {
+			break
+		}
+
+		if !isTimeout(err) {
+			return nil, err
+		}
+
+		now := time.Now()
+		c.expireRequests(now)
+
+		if !idleDeadline.IsZero() && !now.Before(idleDeadline) {
+			if atomic.LoadInt32(&c.inFlight) == 0 {
+				return nil, err
+			}
+
+			idleDeadline = now.Add(c.srv.IdleTimeout)
+		}
+	}
+
+	readDeadline := time.Time{}
+	if c.srv.ReadTimeout > 0 {
+		readDeadline = time.Now().Add(c.srv.ReadTimeout)
+	}
+	deadlines.SetReadDeadline(readDeadline)
+
+	return c.decoder.readPacket(io.MultiReader(bytes.NewReader(first), c.rwc))
+}
+
+// stream is a request being passed on to its handler as its frames arrive.
+// partial checks the frames like the Decoder does and holds those that
+// arrive ahead of next, the sequence the body expects.
+type stream struct {
+	body    *requestBody
+	partial *partialRequest
+	next    int32
+}
+
+// streamPacket passes packet on to the body of the streamed request it
+// belongs to. The first packet of a request starts a new one, which is
+// returned to be dispatched.
+func (c *conn) streamPacket(packet *Packet) (*Request, error) {
+	if st := c.streams[packet.requestId]; st != nil {
+		return nil, c.pushStream(st, packet)
+	}
+
+	if packet.sequence != 0 {
+		return nil, InvalidPacketSequence
+	}
+
+	last := packet.isLast()
+	maxOpen := c.decoder.maxOpenRequests()
+	if !last && len(c.streams) >= maxOpen || int(atomic.LoadInt32(&c.queued)) >= maxOpen {
+		return nil, TooManyOpenRequests
+	}
+
+	req, err := constructRequest([]*Packet{packet})
+	if err != nil {
+		return nil, err
+	}
+
+	payload := req.Payload
+	req.Payload = nil
+
+	if last {
+		req.Body = ioutil.NopCloser(bytes.NewReader(payload))
+		return req, nil
+	}
+
+	st := &stream{body: newRequestBody(), partial: newPartialRequest(packet)}
+	c.streams[packet.requestId] = st
+
+	req.Body = st.body
+
+	return req, c.pushStream(st, packet)
+}
+
+// pushStream adds packet to st and passes every packet that is now next in
+// sequence on to the body.
+func (c *conn) pushStream(st *stream, packet *Packet) error {
+	if packet.sequence < st.next {
+		return DuplicatePacket
+	}
+
+	if err := st.partial.add(packet); err != nil {
+		return err
+	}
+
+	if c.srv.MaxRequestBytes > 0 && st.partial.length > c.srv.MaxRequestBytes {
+		return RequestPayloadLengthExceeded
+	}
+
+	for {
+		next := st.partial.packets[st.next]
+		if next == nil {
+			break
+		}
+
+		delete(st.partial.packets, st.next)
+		st.next++
+
+		// The frames of a body the handler has closed are discarded.
+		if !st.body.isClosed() {
+			st.body.push(next.payload, c.quitChan)
+		}
+	}
+
+	if st.partial.total > 0 && st.next == st.partial.total {
+		delete(c.streams, packet.requestId)
+		st.body.finish(nil)
+	}
+
+	return nil
+}
+
+// abortStreams fails the streamed requests that will not receive any more
+// frames.
+func (c *conn) abortStreams() {
+	for requestID, st := range c.streams {
+		delete(c.streams, requestID)
+		st.body.finish(io.ErrUnexpectedEOF)
+	}
+}
+
+func (c *conn) nextReadDeadline(idleDeadline time.Time) time.Time {
+	deadline := idleDeadline
+
+	if c.srv.ReassemblyTimeout > 0 {
+		oldest, ok := c.decoder.oldest()
+		for _, st := range c.streams {
+			if !ok || st.partial.started.Before(oldest) {
+				oldest, ok = st.partial.started, true
+			}
+		}
+
+		if ok {
+			expiry := oldest.Add(c.srv.ReassemblyTimeout)
+			if deadline.IsZero() || expiry.Before(deadline) {
+				deadline = expiry
+			}
+		}
+	}
+
+	return deadline
+}
+
+func (c *conn) expireRequests(now time.Time) {
+	if c.srv.ReassemblyTimeout <= 0 {
+		return
+	}
+
+	deadline := now.Add(-c.srv.ReassemblyTimeout)
+
+	for _, requestID := range c.decoder.expire(deadline) {
+		c.reportError(&ReassemblyTimeoutError{RequestID: requestID})
+	}
+
+	for requestID, st := range c.streams {
+		if st.partial.started.Before(deadline) {
+			err := &ReassemblyTimeoutError{RequestID: requestID}
+			delete(c.streams, requestID)
+			st.body.finish(err)
+			c.reportError(err)
+		}
+	}
+}
+
+func (c *conn) reportError(err error) {
+	if c.srv.ErrorHook != nil {
+		c.srv.ErrorHook(c, err)
+		return
+	}
+
+	logger.Println("conn.Serve:", err)
+}
+
+// startHandler registers an in-flight handler, reporting false once the
+// connection has stopped dispatching new requests.
+func (c *conn) startHandler() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.draining {
+		return false
+	}
+
+	c.handlers.Add(1)
+	atomic.AddInt32(&c.inFlight, 1)
+
+	return true
+}
+
+func (c *conn) finishHandler() {
+	atomic.AddInt32(&c.inFlight, -1)
+	c.handlers.Done()
+}
+
+func (c *conn) stopDispatch() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.draining = true
+}
+
+func (c *conn) beginShutdown() {
+	c.mu.Lock()
+	c.draining = true
+	c.closeReason = CloseReason{Code: CLOSE_GOING_AWAY}
+	c.mu.Unlock()
 
-	logger.Println("conn.serve: Connected client:", c)
+	c.sendClose(CLOSE_GOING_AWAY, nil)
+}
+
+// sendClose writes a close frame unless one has already been sent.
+func (c *conn) sendClose(code int, payload []byte) {
+	c.mu.Lock()
+	sent := c.closeSent
+	c.closeSent = true
+	c.mu.Unlock()
+
+	if !sent {
+		NewCloseRequest(code, payload).writeFrames(c, c.srv.maxFrameSize())
+	}
+}
+
+// flush asks the writer to send every queued frame and then close the
+// connection.
+func (c *conn) flush() {
+	c.flushOnce.Do(func() {
+		close(c.flushChan)
+	})
+}
+
+// Close closes the connection immediately.
+func (c *conn) Close() error {
+	c.quit()
+
+	return nil
+}
+
+// quit closes the connection without sending queued frames.
+func (c *conn) quit() {
+	c.quitOnce.Do(func() {
+		close(c.quitChan)
+		c.rwc.Close()
+	})
+}
+
+func (c *conn) writeFrame(frame []byte) error {
+	if c.srv.WriteTimeout > 0 {
+		if deadlines, ok := c.rwc.(deadlineSetter); ok {
+			deadlines.SetWriteDeadline(time.Now().Add(c.srv.WriteTimeout))
+		}
+	}
+
+	_, err := c.rwc.Write(frame)
+
+	return err
+}
+
+func (c *conn) writeQueuedFrames() {
+	for {
+		frame, ok := c.frames.pop()
+		if !ok {
+			return
+		}
+
+		if err := c.writeFrame(frame); err != nil {
+			return
+		}
+	}
+}
+
+func (c *conn) requestContext() (context.Context, context.CancelFunc) {
+	if c.srv.RequestTimeout > 0 {
+		return context.WithTimeout(c.ctx, c.srv.RequestTimeout)
+	}
+
+	return context.WithCancel(c.ctx)
+}
+
+func (c *conn) serve(ctx context.Context) {
+	c.ctx, c.cancel = context.WithCancel(ctx)
+
+	c.srv.triggerEvent(CLIENT_CONNECT, c, CloseReason{})
+
+	logger.Printf("conn.serve: Connected client: %p", c)
 
 	defer func() {
-		logger.Println("conn.serve: Client has disconnected:", c)
+		logger.Printf("conn.serve: Client has disconnected: %p", c)
 
 		if r := recover(); r != nil {
 			logger.Printf("Recovered client crash: %s", r)
@@ -199,49 +997,207 @@ func (c *conn) serve() {
 		}
 
 		c.mu.Lock()
-		defer c.mu.Unlock()
-
 		c.closed = true
-		close(c.quitChan)
-		close(c.frameChan)
-		c.srv.triggerEvent(CLIENT_DISCONNECT, c)
-		c.rwc.Close()
+		c.draining = true
+		reason := c.closeReason
+		c.mu.Unlock()
 
-		// logger.Println("conn.serve: Client has disconnected:", c, "Done cleaning up")
+		c.cancel()
+		c.rwc.Close()
+		c.srv.triggerEvent(CLIENT_DISCONNECT, c, reason)
+		c.srv.trackConn(c, false)
+		c.srv.detachSession(c.currentSession(), c)
+		close(c.done)
 	}()
 
-	go func() {
+	go c.readRequests()
+
+	for {
+		select {
+		case <-c.quitChan:
+			return
+		case <-c.flushChan:
+			c.writeQueuedFrames()
+			return
+		case <-c.frames.ready:
+		}
+
 		for {
-			responseWriter, err := c.readRequest(c.rwc)
-			if err != nil {
-				if err != io.EOF {
-					logger.Printf("conn.Serve: Error reading:", err)
-				}
+			frame, ok := c.frames.pop()
+			if !ok {
+				break
+			}
 
-				c.quitChan <- true
+			if err := c.writeFrame(frame); err != nil {
+				c.reportError(err)
 				return
 			}
 
-			switch int(responseWriter.req.OpCode) {
-			case OPCODE_PING:
-				responseWriter.reply.OpCode = OPCODE_PONG
-				responseWriter.finishRequest()
+			select {
+			case <-c.quitChan:
+				return
 			default:
-				go func(c *conn, responseWriter *response) {
-					logger.Println("Spawning handler goroutine")
-					c.srv.Handler.ServeTSP(responseWriter, responseWriter.req)
-					responseWriter.finishRequest()
-				}(c, responseWriter)
 			}
 		}
-	}()
+	}
+}
 
+func (c *conn) readRequests() {
 	for {
-		select {
-		case <-c.quitChan:
+		responseWriter, err := c.readRequest()
+		if err != nil {
+			c.abortStreams()
+
+			if err != io.EOF {
+				c.reportError(err)
+			}
+
+			if code := closeCodeForError(err); code != 0 {
+				reason := CloseReason{Code: code, Payload: []byte(err.Error())}
+				c.drainAndClose(reason, reason.Payload)
+				return
+			}
+
+			// The client is gone; let in-flight handlers deliver what they
+			// can before the connection is closed.
+			c.cancel()
+			c.stopDispatch()
+			c.handlers.Wait()
+			c.flush()
+			return
+		}
+
+		switch int(responseWriter.req.OpCode) {
+		case OPCODE_CLOSE:
+			c.abortStreams()
+			c.handleClose(parseCloseReason(responseWriter.req))
 			return
-		case frame := <-c.frameChan:
-			c.rwc.Write(frame)
+		case OPCODE_PING:
+			responseWriter.reply.OpCode = OPCODE_PONG
+			responseWriter.finishRequest()
+		case OPCODE_PONG:
+			c.srv.triggerPong(c, responseWriter.req)
+		case OPCODE_ACK:
+			c.currentSession().ack(responseWriter.req.RequestID)
+		case OPCODE_SESSION:
+			if len(responseWriter.req.Payload) != len(SessionID{}) {
+				c.reportError(InvalidSessionID)
+				continue
+			}
+
+			var id SessionID
+			copy(id[:], responseWriter.req.Payload)
+			c.srv.resumeSession(c, id)
+		default:
+			if !c.startHandler() {
+				logger.Println("conn.Serve: Dropping request received during shutdown")
+				continue
+			}
+
+			if c.srv.StreamRequests {
+				c.dispatchStreamed(responseWriter)
+				continue
+			}
+
+			c.dispatch(responseWriter)
 		}
 	}
 }
+
+// dispatchStreamed dispatches a streamed request. Waiting for a worker would
+// stop the reader from passing frames on to the handlers that are running, so
+// under OVERLOAD_QUEUE the request waits on its own goroutine.
+func (c *conn) dispatchStreamed(responseWriter *response) {
+	d := c.srv.Dispatcher
+	if d == nil || d.Overload != OVERLOAD_QUEUE {
+		c.dispatch(responseWriter)
+		return
+	}
+
+	atomic.AddInt32(&c.queued, 1)
+	go func() {
+		defer atomic.AddInt32(&c.queued, -1)
+		c.dispatch(responseWriter)
+	}()
+}
+
+func (c *conn) dispatch(responseWriter *response) {
+	handle := func() {
+		defer c.finishHandler()
+
+		ctx, cancel := c.requestContext()
+		defer cancel()
+
+		responseWriter.req.ctx = ctx
+		if body, ok := responseWriter.req.Body.(*requestBody); ok {
+			body.start()
+		}
+		c.serveHandler(responseWriter)
+		if responseWriter.req.Body != nil {
+			responseWriter.req.Body.Close()
+		}
+		responseWriter.finishRequest()
+	}
+
+	d := c.srv.Dispatcher
+	if d == nil {
+		logger.Println("Spawning handler goroutine")
+		go handle()
+		return
+	}
+
+	// A job the dispatcher drops on close still has to be finished, or the
+	// connection would wait for it forever.
+	drop := func() {
+		defer c.finishHandler()
+
+		if responseWriter.req.Body != nil {
+			responseWriter.req.Body.Close()
+		}
+	}
+
+	if err := d.dispatch(responseWriter.req.Priority, c.slots, c.done, handle, drop); err != nil {
+		defer drop()
+
+		c.reportError(err)
+
+		if d.Overload == OVERLOAD_REJECT {
+			responseWriter.WriteError(STATUS_UNAVAILABLE, err.Error())
+			responseWriter.finishRequest()
+		}
+	}
+}
+
+// serveHandler runs the handler for w. A panic is logged and answered with
+// an internal error reply so that the connection outlives the handler.
+func (c *conn) serveHandler(w *response) {
+	defer func() {
+		if err := recover(); err != nil {
+			c.srv.errorLog().Printf("Recovered handler panic for request %x: %v\n%s", w.req.RequestID, err, debug.Stack())
+			w.WriteError(STATUS_INTERNAL_ERROR, handlerPanicMessage)
+		}
+	}()
+
+	c.srv.Handler.ServeTSP(w, w.req)
+}
+
+// handleClose completes a close handshake: no further requests are read,
+// pending replies are sent, the close frame is echoed and the connection is
+// closed.
+func (c *conn) handleClose(reason CloseReason) {
+	c.drainAndClose(reason, nil)
+}
+
+// drainAndClose stops dispatching requests, waits for in-flight handlers to
+// reply and then closes the connection with a close frame carrying
+// reason.Code and payload.
+func (c *conn) drainAndClose(reason CloseReason, payload []byte) {
+	c.mu.Lock()
+	c.draining = true
+	c.closeReason = reason
+	c.mu.Unlock()
+
+	c.handlers.Wait()
+	c.sendClose(reason.Code, payload)
+	c.flush()
+}
@@ -2,11 +2,15 @@ package teaspoon
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	. "github.com/smartystreets/goconvey/convey"
 	"io"
+	"io/ioutil"
+	"log"
 	"net"
-	"sync"
+	"runtime"
 	"testing"
 	"time"
 )
@@ -63,7 +67,7 @@ type dummyListener struct {
 
 func (l *dummyListener) Accept() (net.Conn, error) {
 	if l.index >= len(l.conns) {
-		return nil, &net.OpError{"read", "tcp", l.Addr(), errors.New("Connection closed")}
+		return nil, &net.OpError{Op: "read", Net: "tcp", Addr: l.Addr(), Err: errors.New("Connection closed")}
 	}
 
 	conn := l.conns[l.index]
@@ -83,15 +87,17 @@ func (l *dummyListener) Close() error {
 }
 
 func TestConnWrite(t *testing.T) {
-	Convey("Writing to the conn should stack to the frame chan", t, func() {
+	Convey("Writing to the conn should stack to the frame queue", t, func() {
 		reader := bytes.NewBuffer([]byte{})
 		writer := bytes.NewBuffer([]byte{})
 
 		rwc := &dummyConn{Reader: reader, Writer: writer}
-		conn := &conn{rwc: rwc, srv: nil, frameChan: make(chan []byte, 10), quitChan: make(chan bool), mu: &sync.Mutex{}}
+		conn := newConn(rwc, nil)
 		conn.Write([]byte("HELLO WORLD"))
 
-		So(<-conn.frameChan, ShouldResemble, []byte("HELLO WORLD"))
+		frame, ok := conn.frames.pop()
+		So(ok, ShouldBeTrue)
+		So(frame, ShouldResemble, []byte("HELLO WORLD"))
 	})
 }
 
@@ -102,8 +108,8 @@ func TestConnServe(t *testing.T) {
 		writer := bytes.NewBuffer([]byte{})
 
 		rwc := &dummyConn{Reader: reader, Writer: writer}
-		conn := &conn{rwc: rwc, srv: server, frameChan: make(chan []byte, 10), quitChan: make(chan bool), mu: &sync.Mutex{}}
-		conn.serve()
+		conn := newConn(rwc, server)
+		conn.serve(context.Background())
 
 		So(writer.Bytes(), ShouldResemble, []byte{})
 		So(rwc.closed, ShouldBeTrue)
@@ -117,7 +123,7 @@ func TestConnServe(t *testing.T) {
 		})
 		server := &Server{Handler: handler}
 		reader := bytes.NewBuffer([]byte{
-			0x85, 0x04, 0x12, 0x34,
+			0x25, 0x04, 0x12, 0x34,
 			0x00, 0x00, 0x00, 0x01,
 			0x00, 0x00, 0x00, 0x00,
 			0x00, 0x00, 0x00, 0x00,
@@ -129,8 +135,8 @@ func TestConnServe(t *testing.T) {
 		writer := bytes.NewBuffer([]byte{})
 
 		rwc := &dummyConn{Reader: reader, Writer: writer}
-		conn := &conn{rwc: rwc, srv: server, frameChan: make(chan []byte, 10), quitChan: make(chan bool), mu: &sync.Mutex{}}
-		conn.serve()
+		conn := newConn(rwc, server)
+		conn.serve(context.Background())
 
 		So(<-handler_called, ShouldBeTrue)
 		So(writer.Bytes(), ShouldResemble, []byte{
@@ -147,9 +153,164 @@ func TestConnServe(t *testing.T) {
 	})
 }
 
+func TestConnServeContext(t *testing.T) {
+	request := []byte{
+		0x25, 0x04, 0x12, 0x34,
+		0x00, 0x00, 0x00, 0x01,
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x01,
+		0x00, 0x00, 0x00, 0x01,
+		0x12,
+	}
+
+	Convey("The request context should be cancelled once the client disconnects", t, func() {
+		cancelled := make(chan error, 1)
+		handler := HandlerFunc(func(w ResponseWriter, r *Request) {
+			<-r.Context().Done()
+			cancelled <- r.Context().Err()
+		})
+		server := &Server{Handler: handler}
+
+		rwc := &dummyConn{Reader: bytes.NewBuffer(request), Writer: bytes.NewBuffer([]byte{})}
+		newConn(rwc, server).serve(context.Background())
+
+		So(<-cancelled, ShouldEqual, context.Canceled)
+	})
+
+	Convey("The request context should carry the server's request timeout", t, func() {
+		deadlines := make(chan bool, 1)
+		handler := HandlerFunc(func(w ResponseWriter, r *Request) {
+			deadline, ok := r.Context().Deadline()
+			deadlines <- ok && time.Until(deadline) <= time.Minute
+		})
+		server := &Server{Handler: handler, RequestTimeout: time.Minute}
+
+		reader, writer := io.Pipe()
+		rwc := &dummyConn{Reader: reader, Writer: bytes.NewBuffer([]byte{})}
+		go newConn(rwc, server).serve(context.Background())
+		writer.Write(request)
+
+		So(<-deadlines, ShouldBeTrue)
+		writer.Close()
+	})
+
+	Convey("WithContext should return a copy carrying the new context", t, func() {
+		r := &Request{Payload: []byte("HELLO")}
+		So(r.Context(), ShouldEqual, context.Background())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		r2 := r.WithContext(ctx)
+		So(r2.Context(), ShouldEqual, ctx)
+		So(r2.Payload, ShouldResemble, r.Payload)
+		So(r.Context(), ShouldEqual, context.Background())
+	})
+}
+
+func TestConnServeClose(t *testing.T) {
+	Convey("A close frame should drain pending replies, echo the close and report the reason", t, func() {
+		release := make(chan bool)
+		handler := HandlerFunc(func(w ResponseWriter, r *Request) {
+			<-release
+			w.Write([]byte("BYE"))
+		})
+		binder := &dummyBinder{}
+		server := &Server{Handler: handler}
+		server.AddBinder(binder)
+
+		incoming := bytes.NewBuffer([]byte{})
+		(&Request{OpCode: OPCODE_BINARY, RequestID: RequestID{1}}).WriteTo(incoming)
+		NewCloseRequest(CLOSE_NORMAL, []byte("DONE")).WriteTo(incoming)
+		(&Request{OpCode: OPCODE_BINARY, RequestID: RequestID{2}}).WriteTo(incoming)
+
+		writer := bytes.NewBuffer([]byte{})
+		rwc := &dummyConn{Reader: incoming, Writer: writer}
+
+		served := make(chan bool)
+		go func() {
+			newConn(rwc, server).serve(context.Background())
+			served <- true
+		}()
+		release <- true
+		<-served
+
+		reply, err := ReadRequest(writer)
+		So(err, ShouldBeNil)
+		So(reply.RequestID, ShouldResemble, RequestID{1})
+		So(reply.Payload, ShouldResemble, []byte("BYE"))
+
+		closeFrame, err := ReadRequest(writer)
+		So(err, ShouldBeNil)
+		So(closeFrame.OpCode, ShouldEqual, OPCODE_CLOSE)
+		So(parseCloseReason(closeFrame).Code, ShouldEqual, CLOSE_NORMAL)
+
+		_, err = ReadRequest(writer)
+		So(err, ShouldEqual, io.EOF)
+
+		So(rwc.closed, ShouldBeTrue)
+		So(binder.disconnectCalled, ShouldBeTrue)
+		So(binder.reason.Code, ShouldEqual, CLOSE_NORMAL)
+		So(binder.reason.Payload, ShouldResemble, []byte("DONE"))
+	})
+
+	Convey("A client shutdown should receive its pending replies before the connection closes", t, func() {
+		release := make(chan bool)
+		handler := HandlerFunc(func(w ResponseWriter, r *Request) {
+			<-release
+			w.Write(r.Payload)
+		})
+		server := &Server{Handler: handler}
+
+		clientConn, serverConn := net.Pipe()
+		go newConn(serverConn, server).serve(context.Background())
+		client := NewClient(clientConn)
+
+		call := client.Go(&Request{OpCode: OPCODE_BINARY, Payload: []byte("HELLO")}, nil)
+
+		shutdown := make(chan error, 1)
+		go func() { shutdown <- client.Shutdown(context.Background()) }()
+		close(release)
+
+		So(<-shutdown, ShouldBeNil)
+		So(<-call.Done, ShouldEqual, call)
+		So(call.Error, ShouldBeNil)
+		So(call.Reply.Payload, ShouldResemble, []byte("HELLO"))
+
+		late := client.Go(&Request{OpCode: OPCODE_BINARY}, nil)
+		So(late.Error, ShouldEqual, ClientClosed)
+	})
+
+	Convey("A client should echo a close frame sent by a shutting down server", t, func() {
+		binder := &dummyBinder{}
+		server := &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Request) {})}
+		server.AddBinder(binder)
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		go server.Serve(l)
+
+		client, err := Dial(l.Addr().String())
+		So(err, ShouldBeNil)
+
+		_, err = client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY})
+		So(err, ShouldBeNil)
+
+		So(server.Shutdown(context.Background()), ShouldBeNil)
+		<-client.done
+
+		_, err = client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY})
+		So(err, ShouldEqual, ClientClosed)
+		So(binder.disconnectCalled, ShouldBeTrue)
+	})
+}
+
 type dummyBinder struct {
 	connectCalled    bool
 	disconnectCalled bool
+	reason           CloseReason
 }
 
 func (b *dummyBinder) OnClientConnect(c io.Writer) error {
@@ -157,8 +318,9 @@ func (b *dummyBinder) OnClientConnect(c io.Writer) error {
 	return nil
 }
 
-func (b *dummyBinder) OnClientDisconnect(c io.Writer) {
+func (b *dummyBinder) OnClientDisconnect(c io.Writer, reason CloseReason) {
 	b.disconnectCalled = true
+	b.reason = reason
 }
 
 func TestServerAddBinder(t *testing.T) {
@@ -179,15 +341,41 @@ func TestServerTriggerEvent(t *testing.T) {
 		binder := &dummyBinder{}
 		server.AddBinder(binder)
 		So(binder.connectCalled, ShouldEqual, false)
-		server.triggerEvent(CLIENT_CONNECT, &dummyConn{})
+		server.triggerEvent(CLIENT_CONNECT, &dummyConn{}, CloseReason{})
 		So(binder.connectCalled, ShouldEqual, true)
 
 		So(binder.disconnectCalled, ShouldEqual, false)
-		server.triggerEvent(CLIENT_DISCONNECT, &dummyConn{})
+		server.triggerEvent(CLIENT_DISCONNECT, &dummyConn{}, CloseReason{Code: CLOSE_NORMAL})
 		So(binder.disconnectCalled, ShouldEqual, true)
 	})
 }
 
+type pongBinder struct {
+	dummyBinder
+	pongs chan *Request
+}
+
+func (b *pongBinder) OnPong(c io.Writer, r *Request) {
+	b.pongs <- r
+}
+
+func TestServerTriggerPong(t *testing.T) {
+	Convey("Pongs received from a client should be handed to binders instead of the handler", t, func() {
+		binder := &pongBinder{pongs: make(chan *Request, 1)}
+		server := &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Request) { w.Write([]byte("HANDLED")) })}
+		server.AddBinder(binder)
+
+		clientConn, serverConn := net.Pipe()
+		go newConn(serverConn, server).serve(context.Background())
+		defer clientConn.Close()
+
+		pong := &Request{OpCode: OPCODE_PONG, RequestID: NewRequestID()}
+		pong.WriteTo(clientConn)
+
+		So((<-binder.pongs).RequestID, ShouldResemble, pong.RequestID)
+	})
+}
+
 func TestServerServe(t *testing.T) {
 	server := &Server{}
 
@@ -228,3 +416,804 @@ func TestServerServe(t *testing.T) {
 		So(listener.conns[1].closed, ShouldBeTrue)
 	})
 }
+
+func TestServerShutdown(t *testing.T) {
+	request := &Request{OpCode: OPCODE_BINARY, RequestID: RequestID{1}, Payload: []byte("HELLO")}
+
+	Convey("Shutdown should send a close frame and wait for in-flight handlers", t, func() {
+		started := make(chan bool, 1)
+		release := make(chan bool)
+		handler := HandlerFunc(func(w ResponseWriter, r *Request) {
+			started <- true
+			<-release
+			w.Write([]byte("BYE"))
+		})
+		server := &Server{Handler: handler}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+
+		served := make(chan error, 1)
+		go func() { served <- server.Serve(l) }()
+
+		client, err := net.Dial("tcp", l.Addr().String())
+		So(err, ShouldBeNil)
+		defer client.Close()
+
+		request.WriteTo(client)
+		<-started
+
+		shutdown := make(chan error, 1)
+		go func() { shutdown <- server.Shutdown(context.Background()) }()
+
+		closeFrame, err := ReadRequest(client)
+		So(err, ShouldBeNil)
+		So(closeFrame.OpCode, ShouldEqual, OPCODE_CLOSE)
+		So(<-served, ShouldEqual, ServerClosed)
+
+		release <- true
+
+		reply, err := ReadRequest(client)
+		So(err, ShouldBeNil)
+		So(reply.RequestID, ShouldResemble, request.RequestID)
+		So(reply.Payload, ShouldResemble, []byte("BYE"))
+
+		So(<-shutdown, ShouldBeNil)
+
+		_, err = ReadRequest(client)
+		So(err, ShouldEqual, io.EOF)
+
+		So(server.Serve(l), ShouldEqual, ServerClosed)
+	})
+
+	Convey("Shutdown should not cancel the context of in-flight handlers", t, func() {
+		started := make(chan bool, 1)
+		release := make(chan bool)
+		ctxErr := make(chan error, 1)
+		handler := HandlerFunc(func(w ResponseWriter, r *Request) {
+			started <- true
+			<-release
+			ctxErr <- r.Context().Err()
+		})
+		server := &Server{Handler: handler}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+
+		served := make(chan error, 1)
+		go func() { served <- server.Serve(l) }()
+
+		client, err := net.Dial("tcp", l.Addr().String())
+		So(err, ShouldBeNil)
+		defer client.Close()
+
+		request.WriteTo(client)
+		<-started
+
+		shutdown := make(chan error, 1)
+		go func() { shutdown <- server.Shutdown(context.Background()) }()
+		So(<-served, ShouldEqual, ServerClosed)
+
+		release <- true
+		So(<-ctxErr, ShouldBeNil)
+		So(<-shutdown, ShouldBeNil)
+	})
+
+	Convey("Connections should not be tracked once the server is shutting down", t, func() {
+		server := &Server{}
+		So(server.trackConn(newConn(&dummyConn{}, server), true), ShouldBeTrue)
+
+		conns, err := server.beginClose()
+		So(err, ShouldBeNil)
+		So(len(conns), ShouldEqual, 1)
+
+		So(server.trackConn(newConn(&dummyConn{}, server), true), ShouldBeFalse)
+	})
+
+	Convey("Shutdown should give up when the context expires", t, func() {
+		started := make(chan bool, 1)
+		release := make(chan bool)
+		handler := HandlerFunc(func(w ResponseWriter, r *Request) {
+			started <- true
+			<-release
+		})
+		defer close(release)
+		server := &Server{Handler: handler}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		go server.Serve(l)
+
+		client, err := net.Dial("tcp", l.Addr().String())
+		So(err, ShouldBeNil)
+		defer client.Close()
+
+		request.WriteTo(client)
+		<-started
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+		defer cancel()
+
+		So(server.Shutdown(ctx), ShouldEqual, context.DeadlineExceeded)
+	})
+
+	Convey("Close should drop connections without waiting for handlers", t, func() {
+		started := make(chan bool, 1)
+		release := make(chan bool)
+		handler := HandlerFunc(func(w ResponseWriter, r *Request) {
+			started <- true
+			<-release
+		})
+		defer close(release)
+		server := &Server{Handler: handler}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+
+		served := make(chan error, 1)
+		go func() { served <- server.Serve(l) }()
+
+		client, err := net.Dial("tcp", l.Addr().String())
+		So(err, ShouldBeNil)
+		defer client.Close()
+
+		request.WriteTo(client)
+		<-started
+
+		So(server.Close(), ShouldBeNil)
+		So(<-served, ShouldEqual, ServerClosed)
+
+		_, err = ReadRequest(client)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestConnTimeouts(t *testing.T) {
+	Convey("A client that stops in the middle of a frame should be disconnected after the read timeout", t, func() {
+		errs := make(chan error, 1)
+		server := &Server{
+			Handler:     HandlerFunc(func(w ResponseWriter, r *Request) {}),
+			ReadTimeout: time.Millisecond * 20,
+			ErrorHook:   func(c io.Writer, err error) { errs <- err },
+		}
+
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+
+		c := newConn(serverConn, server)
+		go c.serve(context.Background())
+
+		clientConn.Write([]byte{0x25, 0x04, 0x12, 0x34})
+
+		So(isTimeout(<-errs), ShouldBeTrue)
+		<-c.done
+	})
+
+	Convey("An idle client should be disconnected after the idle timeout", t, func() {
+		server := &Server{
+			Handler:     HandlerFunc(func(w ResponseWriter, r *Request) {}),
+			IdleTimeout: time.Millisecond * 20,
+			ErrorHook:   func(c io.Writer, err error) {},
+		}
+
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+
+		c := newConn(serverConn, server)
+		go c.serve(context.Background())
+
+		<-c.done
+	})
+
+	Convey("A connection with a request in flight should not be considered idle", t, func() {
+		handler := HandlerFunc(func(w ResponseWriter, r *Request) {
+			time.Sleep(time.Millisecond * 60)
+			w.Write([]byte("SLOW"))
+		})
+		server := &Server{
+			Handler:     handler,
+			IdleTimeout: time.Millisecond * 20,
+			ErrorHook:   func(c io.Writer, err error) {},
+		}
+
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		go newConn(serverConn, server).serve(context.Background())
+
+		(&Request{OpCode: OPCODE_BINARY, RequestID: RequestID{1}}).WriteTo(clientConn)
+
+		reply, err := ReadRequest(clientConn)
+		So(err, ShouldBeNil)
+		So(reply.Payload, ShouldResemble, []byte("SLOW"))
+	})
+
+	Convey("A partially received request should expire after the reassembly timeout", t, func() {
+		errs := make(chan error, 1)
+		server := &Server{
+			Handler:           HandlerFunc(func(w ResponseWriter, r *Request) { w.Write(r.Payload) }),
+			ReassemblyTimeout: time.Millisecond * 20,
+			ErrorHook:         func(c io.Writer, err error) { errs <- err },
+		}
+
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+
+		c := newConn(serverConn, server)
+		go c.serve(context.Background())
+
+		partial := &Request{OpCode: OPCODE_BINARY, RequestID: RequestID{1}, Payload: []byte("HELLO WORLD")}
+		clientConn.Write(partial.GetFrames(5)[0])
+
+		err := <-errs
+		So(err, ShouldResemble, &ReassemblyTimeoutError{RequestID: RequestID{1}})
+
+		_, pending := c.decoder.oldest()
+		So(pending, ShouldBeFalse)
+
+		(&Request{OpCode: OPCODE_BINARY, RequestID: RequestID{2}, Payload: []byte("HELLO")}).WriteTo(clientConn)
+
+		reply, err := ReadRequest(clientConn)
+		So(err, ShouldBeNil)
+		So(reply.RequestID, ShouldResemble, RequestID{2})
+		So(reply.Payload, ShouldResemble, []byte("HELLO"))
+	})
+}
+
+func TestConnWritePriority(t *testing.T) {
+	Convey("Frames of a higher priority reply should overtake a queued low priority reply", t, func() {
+		writer := bytes.NewBuffer([]byte{})
+		rwc := &dummyConn{Reader: bytes.NewBuffer([]byte{}), Writer: writer}
+		conn := newConn(rwc, &Server{})
+
+		bulk := &Request{OpCode: OPCODE_BINARY, Priority: 1, RequestID: RequestID{1}, Payload: bytes.Repeat([]byte("B"), 40)}
+		bulk.writeFrames(conn, 5)
+
+		urgent := &Request{OpCode: OPCODE_BINARY, Priority: 15, RequestID: RequestID{2}, Payload: []byte("URGENT")}
+		urgent.WriteTo(conn)
+
+		conn.serve(context.Background())
+
+		first, err := ReadPacket(writer)
+		So(err, ShouldBeNil)
+		So(first.priority, ShouldEqual, 15)
+		So(first.requestId, ShouldResemble, RequestID{2})
+
+		reply, err := ReadRequest(writer)
+		So(err, ShouldBeNil)
+		So(reply.RequestID, ShouldResemble, RequestID{1})
+		So(reply.Payload, ShouldResemble, bulk.Payload)
+	})
+
+	Convey("Frames of the same priority should keep their order", t, func() {
+		queue := newFrameQueue(4)
+		queue.push([]byte{0x21, 1}, nil)
+		queue.push([]byte{0x25, 2}, nil)
+		queue.push([]byte{0x21, 3}, nil)
+
+		order := []byte{}
+		for frame, ok := queue.pop(); ok; frame, ok = queue.pop() {
+			order = append(order, frame[1])
+		}
+
+		So(order, ShouldResemble, []byte{2, 1, 3})
+	})
+
+	Convey("Pushing onto a full queue should block until a frame is taken", t, func() {
+		queue := newFrameQueue(1)
+		queue.push([]byte{0x21, 1}, nil)
+
+		pushed := make(chan error)
+		go func() { pushed <- queue.push([]byte{0x21, 2}, nil) }()
+
+		select {
+		case <-pushed:
+			t.Fatal("push should block while the queue is full")
+		case <-time.After(time.Millisecond * 10):
+		}
+
+		frame, _ := queue.pop()
+		So(frame, ShouldResemble, []byte{0x21, 1})
+		So(<-pushed, ShouldBeNil)
+
+		done := make(chan bool)
+		close(done)
+		So(queue.push([]byte{0x21, 3}, done), ShouldEqual, ConnClosed)
+	})
+}
+
+func TestConnStreamRequests(t *testing.T) {
+	Convey("The handler should start on the first frame and read the rest from Body", t, func() {
+		started := make(chan bool)
+		server := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+				close(started)
+				payload, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					w.WriteError(STATUS_BAD_REQUEST, err.Error())
+					return
+				}
+				w.Write(payload)
+			}),
+			MaxFrameSize:   4,
+			StreamRequests: true,
+		}
+
+		clientConn, serverConn := net.Pipe()
+		go newConn(serverConn, server).serve(context.Background())
+		defer clientConn.Close()
+
+		req := &Request{OpCode: OPCODE_BINARY, RequestID: NewRequestID(), Payload: []byte("HELLO WORLD")}
+		frames := req.GetFrames(4)
+
+		clientConn.Write(frames[0])
+		<-started
+
+		for _, frame := range frames[1:] {
+			clientConn.Write(frame)
+		}
+
+		reply, err := ReadRequest(clientConn)
+		So(err, ShouldBeNil)
+		So(reply.RequestID, ShouldResemble, req.RequestID)
+		So(reply.Payload, ShouldResemble, []byte("HELLO WORLD"))
+	})
+
+	Convey("Reading the body of a request cut short should fail", t, func() {
+		errs := make(chan error, 1)
+		server := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+				_, err := ioutil.ReadAll(r.Body)
+				errs <- err
+			}),
+			MaxFrameSize:   4,
+			StreamRequests: true,
+		}
+
+		clientConn, serverConn := net.Pipe()
+		go newConn(serverConn, server).serve(context.Background())
+
+		req := &Request{OpCode: OPCODE_BINARY, RequestID: NewRequestID(), Payload: []byte("HELLO WORLD")}
+		clientConn.Write(req.GetFrames(4)[0])
+		clientConn.Close()
+
+		So(<-errs, ShouldEqual, io.ErrUnexpectedEOF)
+	})
+
+	Convey("Single frame requests should carry their payload in Body only", t, func() {
+		server := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				w.Write(append(r.Payload, body...))
+			}),
+			StreamRequests: true,
+		}
+
+		clientConn, serverConn := net.Pipe()
+		go newConn(serverConn, server).serve(context.Background())
+		client := NewClient(clientConn)
+		defer client.Close()
+
+		reply, err := client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY, Payload: []byte("HI")})
+		So(err, ShouldBeNil)
+		So(reply.Payload, ShouldResemble, []byte("HI"))
+	})
+
+	Convey("A session announced while streaming requests should be resumed", t, func() {
+		errs := make(chan error, 1)
+		server := &Server{
+			Handler:        HandlerFunc(func(w ResponseWriter, r *Request) {}),
+			ErrorHook:      func(c io.Writer, err error) { errs <- err },
+			StreamRequests: true,
+		}
+		id := NewSessionID()
+
+		clientConn, serverConn := net.Pipe()
+		go newConn(serverConn, server).serve(context.Background())
+		client := NewClient(clientConn, WithSession(id))
+		defer client.Close()
+
+		_, err := client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY})
+		So(err, ShouldBeNil)
+		So(len(errs), ShouldEqual, 0)
+
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		So(server.sessions[id], ShouldNotBeNil)
+	})
+
+	Convey("A close frame received while streaming requests should report its reason", t, func() {
+		binder := &dummyBinder{}
+		server := &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Request) {}), StreamRequests: true}
+		server.AddBinder(binder)
+
+		incoming := bytes.NewBuffer([]byte{})
+		NewCloseRequest(CLOSE_NORMAL, []byte("bye")).WriteTo(incoming)
+
+		newConn(&dummyConn{Reader: incoming, Writer: ioutil.Discard}, server).serve(context.Background())
+
+		So(binder.reason.Code, ShouldEqual, CLOSE_NORMAL)
+		So(binder.reason.Payload, ShouldResemble, []byte("bye"))
+	})
+
+	Convey("The frames of a streamed request the dispatcher refused should be discarded", t, func() {
+		block := make(chan bool)
+		server := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+				if r.Resource == 1 {
+					<-block
+				}
+				w.Write([]byte("DONE"))
+			}),
+			Dispatcher:     &Dispatcher{Bands: []PriorityBand{{Workers: 2}}, MaxInFlightPerConn: 1, Overload: OVERLOAD_DROP},
+			ErrorHook:      func(c io.Writer, err error) {},
+			MaxFrameSize:   1,
+			StreamRequests: true,
+		}
+		defer server.Close()
+
+		clientConn, serverConn := net.Pipe()
+		go newConn(serverConn, server).serve(context.Background())
+		defer clientConn.Close()
+
+		blocked := &Request{OpCode: OPCODE_BINARY, Resource: 1, RequestID: RequestID{1}}
+		blocked.WriteTo(clientConn)
+
+		dropped := &Request{OpCode: OPCODE_BINARY, RequestID: RequestID{2}, Payload: []byte("DROPPED")}
+		for _, frame := range dropped.GetFrames(1) {
+			clientConn.Write(frame)
+		}
+
+		close(block)
+
+		reply, err := ReadRequest(clientConn)
+		So(err, ShouldBeNil)
+		So(reply.RequestID, ShouldResemble, RequestID{1})
+
+		// The connection keeps reading requests.
+		(&Request{OpCode: OPCODE_BINARY, RequestID: RequestID{3}}).WriteTo(clientConn)
+
+		reply, err = ReadRequest(clientConn)
+		So(err, ShouldBeNil)
+		So(reply.RequestID, ShouldResemble, RequestID{3})
+	})
+
+	Convey("Streams should count against MaxOpenRequests", t, func() {
+		server := &Server{
+			Handler:         HandlerFunc(func(w ResponseWriter, r *Request) { ioutil.ReadAll(r.Body) }),
+			ErrorHook:       func(c io.Writer, err error) {},
+			MaxFrameSize:    5,
+			MaxOpenRequests: 1,
+			StreamRequests:  true,
+		}
+
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		go newConn(serverConn, server).serve(context.Background())
+
+		go func() {
+			for i := byte(1); i <= 2; i++ {
+				partial := &Request{OpCode: OPCODE_BINARY, RequestID: RequestID{i}, Payload: []byte("HELLO WORLD")}
+				clientConn.Write(partial.GetFrames(5)[0])
+			}
+		}()
+
+		// The handler of the aborted stream replies before the close frame.
+		decoder := NewDecoder(clientConn)
+		frame, err := decoder.Decode()
+		for err == nil && frame.OpCode != OPCODE_CLOSE {
+			frame, err = decoder.Decode()
+		}
+		So(err, ShouldBeNil)
+		So(parseCloseReason(frame).Code, ShouldEqual, CLOSE_POLICY_VIOLATION)
+	})
+
+	Convey("A stream should expire after the reassembly timeout", t, func() {
+		errs := make(chan error, 1)
+		bodyErrs := make(chan error, 1)
+		server := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+				_, err := ioutil.ReadAll(r.Body)
+				bodyErrs <- err
+			}),
+			ErrorHook:         func(c io.Writer, err error) { errs <- err },
+			MaxFrameSize:      5,
+			ReassemblyTimeout: time.Millisecond * 20,
+			StreamRequests:    true,
+		}
+
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		go newConn(serverConn, server).serve(context.Background())
+
+		partial := &Request{OpCode: OPCODE_BINARY, RequestID: RequestID{1}, Payload: []byte("HELLO WORLD")}
+		clientConn.Write(partial.GetFrames(5)[0])
+
+		expired := &ReassemblyTimeoutError{RequestID: RequestID{1}}
+		So(<-errs, ShouldResemble, expired)
+		So(<-bodyErrs, ShouldResemble, expired)
+	})
+
+	for _, dispatcher := range []*Dispatcher{{}, {Bands: []PriorityBand{{Workers: 1, QueueSize: 1}}}} {
+		Convey("Interleaved streams should be answered when a Dispatcher runs the handlers", t, func() {
+			server := &Server{
+				Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+					payload, _ := ioutil.ReadAll(r.Body)
+					w.Write(payload)
+				}),
+				Dispatcher:     dispatcher,
+				MaxFrameSize:   2,
+				StreamRequests: true,
+			}
+			defer server.Close()
+
+			clientConn, serverConn := net.Pipe()
+			go newConn(serverConn, server).serve(context.Background())
+			defer clientConn.Close()
+
+			// The second request's frames outnumber what a running body holds
+			// and arrive while its handler waits for the first one to finish.
+			first := &Request{OpCode: OPCODE_BINARY, RequestID: RequestID{1}, Payload: []byte("HELLO WORLD")}
+			second := &Request{OpCode: OPCODE_BINARY, RequestID: RequestID{2}, Payload: []byte("GOODBYE ALL")}
+			a, b := first.GetFrames(2), second.GetFrames(2)
+			go clientConn.Write(bytes.Join(append(append([][]byte{a[0]}, b...), a[1:]...), nil))
+
+			decoder := NewDecoder(clientConn)
+			replies := map[RequestID]string{}
+			for len(replies) < 2 {
+				reply, err := decoder.Decode()
+				So(err, ShouldBeNil)
+				replies[reply.RequestID] = string(reply.Payload)
+			}
+			So(replies, ShouldResemble, map[RequestID]string{first.RequestID: "HELLO WORLD", second.RequestID: "GOODBYE ALL"})
+		})
+	}
+
+	Convey("Frames arriving out of order should reach the body in sequence", t, func() {
+		server := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+				payload, _ := ioutil.ReadAll(r.Body)
+				w.Write(payload)
+			}),
+			MaxFrameSize:   4,
+			StreamRequests: true,
+		}
+
+		clientConn, serverConn := net.Pipe()
+		go newConn(serverConn, server).serve(context.Background())
+		defer clientConn.Close()
+
+		req := &Request{OpCode: OPCODE_BINARY, RequestID: NewRequestID(), Payload: []byte("HELLO WORLD")}
+		frames := req.GetFrames(4)
+		go clientConn.Write(bytes.Join([][]byte{frames[0], frames[2], frames[1]}, nil))
+
+		reply, err := ReadRequest(clientConn)
+		So(err, ShouldBeNil)
+		So(reply.Payload, ShouldResemble, []byte("HELLO WORLD"))
+	})
+
+	req := &Request{OpCode: OPCODE_BINARY, Method: 1, RequestID: RequestID{1}, Payload: []byte("HELLO WORLD")}
+	frames := req.GetFrames(4)
+	other := *req
+	other.Method = 2
+
+	for name, sent := range map[string][][]byte{
+		"a frame repeating a delivered sequence":   {frames[0], frames[1], frames[1]},
+		"a frame repeating a pending sequence":     {frames[0], frames[2], frames[2]},
+		"a frame without an open stream":           {frames[1]},
+		"a frame disagreeing on the header":        {frames[0], other.GetFrames(4)[1]},
+		"a frame beyond the total sequences":       {frames[0], req.frame(3, 3, 0, []byte("!"))},
+		"a streamed frame following its final one": {req.frame(0, 0, 0, nil), req.frame(1, 0, FLAG_FINAL, nil), req.frame(2, 0, 0, nil)},
+	} {
+		Convey("A streamed request with "+name+" should be closed with a protocol error", t, func() {
+			server := &Server{
+				Handler:        HandlerFunc(func(w ResponseWriter, r *Request) { ioutil.ReadAll(r.Body) }),
+				ErrorHook:      func(c io.Writer, err error) {},
+				StreamRequests: true,
+			}
+
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			go newConn(serverConn, server).serve(context.Background())
+			go clientConn.Write(bytes.Join(sent, nil))
+
+			decoder := NewDecoder(clientConn)
+			frame, err := decoder.Decode()
+			for err == nil && frame.OpCode != OPCODE_CLOSE {
+				frame, err = decoder.Decode()
+			}
+			So(err, ShouldBeNil)
+			So(parseCloseReason(frame).Code, ShouldEqual, CLOSE_PROTOCOL_ERROR)
+		})
+	}
+}
+
+func TestResponseFlush(t *testing.T) {
+	Convey("Flushed data should be sent before the handler returns", t, func() {
+		proceed := make(chan bool)
+		flushed := make(chan error, 1)
+		server := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+				w.Write([]byte("HELLO"))
+				flushed <- w.(Flusher).Flush()
+				<-proceed
+				w.Write([]byte(" WORLD"))
+			}),
+			MaxFrameSize: 4,
+		}
+
+		clientConn, serverConn := net.Pipe()
+		go newConn(serverConn, server).serve(context.Background())
+		defer clientConn.Close()
+
+		req := &Request{OpCode: OPCODE_BINARY, RequestID: NewRequestID()}
+		req.WriteTo(clientConn)
+
+		packets := []*Packet{}
+		for _, payload := range []string{"HELL", "O"} {
+			packet, err := ReadPacket(clientConn)
+			So(err, ShouldBeNil)
+			So(packet.requestId, ShouldResemble, req.RequestID)
+			So(packet.totalSequences, ShouldEqual, 0)
+			So(packet.isLast(), ShouldBeFalse)
+			So(string(packet.payload), ShouldEqual, payload)
+			packets = append(packets, packet)
+		}
+		So(<-flushed, ShouldBeNil)
+		close(proceed)
+
+		for !packets[len(packets)-1].isLast() {
+			packet, err := ReadPacket(clientConn)
+			So(err, ShouldBeNil)
+			packets = append(packets, packet)
+		}
+
+		for i, packet := range packets {
+			So(packet.sequence, ShouldEqual, i)
+		}
+		So(combinePacketPayloads(packets), ShouldResemble, []byte("HELLO WORLD"))
+	})
+
+	Convey("The client should assemble a streamed reply", t, func() {
+		server := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+				for i := 0; i < 3; i++ {
+					w.Write(r.Payload)
+					w.(Flusher).Flush()
+				}
+			}),
+		}
+
+		clientConn, serverConn := net.Pipe()
+		go newConn(serverConn, server).serve(context.Background())
+		client := NewClient(clientConn)
+		defer client.Close()
+
+		reply, err := client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY, Payload: []byte("ABC")})
+		So(err, ShouldBeNil)
+		So(reply.Payload, ShouldResemble, []byte("ABCABCABC"))
+	})
+}
+
+func TestConnHandlerPanic(t *testing.T) {
+	handler := HandlerFunc(func(w ResponseWriter, r *Request) {
+		if string(r.Payload) == "FLUSH" {
+			w.Write([]byte("PARTIAL"))
+			w.(Flusher).Flush()
+		}
+		if string(r.Payload) == "PANIC" || string(r.Payload) == "FLUSH" {
+			panic("BOOM")
+		}
+		w.Write(r.Payload)
+	})
+
+	for _, dispatched := range []bool{false, true} {
+		newServer := func(errorLog *log.Logger) *Server {
+			server := &Server{Handler: handler, ErrorLog: errorLog}
+			if dispatched {
+				server.Dispatcher = &Dispatcher{Bands: []PriorityBand{{Workers: 1}}}
+			}
+			return server
+		}
+
+		Convey("A panicking handler should get an internal error reply and leave the connection open", t, func() {
+			out := &bytes.Buffer{}
+			server := newServer(log.New(out, "", 0))
+			defer server.Close()
+
+			clientConn, serverConn := net.Pipe()
+			c := newConn(serverConn, server)
+			go c.serve(context.Background())
+			client := NewClient(clientConn)
+			defer client.Close()
+
+			_, err := client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY, Payload: []byte("PANIC")})
+			So(err, ShouldResemble, &ReplyError{Code: STATUS_INTERNAL_ERROR, Message: handlerPanicMessage})
+
+			reply, err := client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY, Payload: []byte("ECHO")})
+			So(err, ShouldBeNil)
+			So(reply.Payload, ShouldResemble, []byte("ECHO"))
+
+			client.Close()
+			<-c.done
+			So(out.String(), ShouldContainSubstring, "BOOM")
+			So(out.String(), ShouldContainSubstring, "server_test.go")
+		})
+
+		Convey("A handler panicking after a flush should abort its reply with an internal error", t, func() {
+			server := newServer(log.New(ioutil.Discard, "", 0))
+			defer server.Close()
+
+			clientConn, serverConn := net.Pipe()
+			go newConn(serverConn, server).serve(context.Background())
+			client := NewClient(clientConn)
+			defer client.Close()
+
+			_, err := client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY, Payload: []byte("FLUSH")})
+			So(err, ShouldResemble, &ReplyError{Code: STATUS_INTERNAL_ERROR, Message: handlerPanicMessage})
+
+			reply, err := client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY, Payload: []byte("ECHO")})
+			So(err, ShouldBeNil)
+			So(reply.Payload, ShouldResemble, []byte("ECHO"))
+		})
+	}
+}
+
+func TestConnConcurrentRequests(t *testing.T) {
+	Convey("Concurrent requests on one connection should each receive their own reply", t, func() {
+		server := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+				half := len(r.Payload) / 2
+				w.Write(r.Payload[:half])
+				runtime.Gosched()
+				w.Write(r.Payload[half:])
+			}),
+		}
+
+		clientConn, serverConn := net.Pipe()
+		go newConn(serverConn, server).serve(context.Background())
+		client := NewClient(clientConn)
+		defer client.Close()
+
+		calls := make([]*Call, 500)
+		done := make(chan *Call, len(calls))
+		for i := range calls {
+			payload := []byte(fmt.Sprintf("REQUEST %d", i))
+			calls[i] = client.Go(&Request{OpCode: OPCODE_BINARY, Payload: payload}, done)
+		}
+
+		for range calls {
+			<-done
+		}
+
+		for i, call := range calls {
+			So(call.Error, ShouldBeNil)
+			So(string(call.Reply.Payload), ShouldEqual, fmt.Sprintf("REQUEST %d", i))
+		}
+	})
+}
+
+func TestConnMaxOpenRequests(t *testing.T) {
+	Convey("A client opening more requests than allowed should be disconnected", t, func() {
+		server := &Server{
+			Handler:         HandlerFunc(func(w ResponseWriter, r *Request) {}),
+			MaxOpenRequests: 1,
+			ErrorHook:       func(c io.Writer, err error) {},
+		}
+
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		go newConn(serverConn, server).serve(context.Background())
+
+		go func() {
+			for i := byte(1); i <= 2; i++ {
+				partial := &Request{OpCode: OPCODE_BINARY, RequestID: RequestID{i}, Payload: []byte("HELLO WORLD")}
+				clientConn.Write(partial.GetFrames(5)[0])
+			}
+		}()
+
+		closeFrame, err := ReadRequest(clientConn)
+		So(err, ShouldBeNil)
+		So(closeFrame.OpCode, ShouldEqual, OPCODE_CLOSE)
+		So(parseCloseReason(closeFrame).Code, ShouldEqual, CLOSE_POLICY_VIOLATION)
+	})
+}
@@ -0,0 +1,212 @@
+package teaspoon
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	InvalidSessionID = errors.New("Invalid session ID provided")
+)
+
+// SessionID identifies a client across reconnects. A client announces it with
+// an OPCODE_SESSION frame so that pushes it has not acknowledged yet are sent
+// again on its new connection.
+type SessionID [16]byte
+
+func NewSessionID() SessionID {
+	sessionID := SessionID{}
+	if _, err := rand.Read(sessionID[:]); err != nil {
+		panic(err)
+	}
+
+	return sessionID
+}
+
+// AckTimeoutError is reported to Server.ErrorHook and returned by Conn.Push
+// when a push is not acknowledged within Server.AckTimeout.
+type AckTimeoutError struct {
+	RequestID RequestID
+}
+
+func (e *AckTimeoutError) Error() string {
+	return fmt.Sprintf("Request %x was not acknowledged before the ack timeout", e.RequestID[:])
+}
+
+// session tracks the pushes awaiting an acknowledgement from a client. Every
+// connection starts with an anonymous session, which is replaced by a named
+// one once the client announces its SessionID.
+type session struct {
+	id         SessionID
+	named      bool
+	mu         sync.Mutex
+	conn       *conn
+	deliveries map[RequestID]*delivery
+}
+
+type delivery struct {
+	req   *Request
+	acked chan bool
+}
+
+func newSession(c *conn) *session {
+	return &session{conn: c, deliveries: make(map[RequestID]*delivery)}
+}
+
+func (s *session) track(srv *Server, req *Request) *delivery {
+	s.mu.Lock()
+	d := &delivery{req: req, acked: make(chan bool)}
+	s.deliveries[req.RequestID] = d
+	s.mu.Unlock()
+
+	srv.retainSession(s)
+
+	return d
+}
+
+func (s *session) forget(srv *Server, requestID RequestID) {
+	s.mu.Lock()
+	delete(s.deliveries, requestID)
+	s.mu.Unlock()
+
+	srv.releaseSession(s)
+}
+
+func (s *session) ack(requestID RequestID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if d, ok := s.deliveries[requestID]; ok {
+		delete(s.deliveries, requestID)
+		close(d.acked)
+	}
+}
+
+// send writes the push to the session's current connection. While the client
+// is disconnected the push waits to be retransmitted when it returns.
+func (s *session) send(d *delivery) error {
+	s.mu.Lock()
+	c := s.conn
+	s.mu.Unlock()
+
+	if c == nil {
+		return nil
+	}
+
+	_, err := d.req.writeFrames(c, c.srv.maxFrameSize())
+
+	return err
+}
+
+// attach makes c the session's connection and retransmits every push that
+// is still unacknowledged.
+func (s *session) attach(c *conn) {
+	s.mu.Lock()
+	s.conn = c
+	pending := []*delivery{}
+	for _, d := range s.deliveries {
+		pending = append(pending, d)
+	}
+	s.mu.Unlock()
+
+	for _, d := range pending {
+		if err := s.send(d); err != nil {
+			c.reportError(err)
+			return
+		}
+	}
+}
+
+// adopt moves the deliveries of the anonymous session previous into s.
+func (s *session) adopt(previous *session) {
+	previous.mu.Lock()
+	deliveries := previous.deliveries
+	previous.deliveries = make(map[RequestID]*delivery)
+	previous.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for requestID, d := range deliveries {
+		s.deliveries[requestID] = d
+	}
+}
+
+// resumeSession moves c onto the session named id, creating it if the client
+// has not been seen before.
+func (srv *Server) resumeSession(c *conn, id SessionID) {
+	previous := c.currentSession()
+
+	srv.mu.Lock()
+	if srv.sessions == nil {
+		srv.sessions = make(map[SessionID]*session)
+	}
+
+	s := srv.sessions[id]
+	if s == nil {
+		s = newSession(nil)
+		s.id = id
+		s.named = true
+		srv.sessions[id] = s
+	}
+	srv.mu.Unlock()
+
+	if s == previous {
+		return
+	}
+
+	s.adopt(previous)
+
+	c.mu.Lock()
+	c.session = s
+	c.mu.Unlock()
+
+	s.attach(c)
+	srv.detachSession(previous, c)
+}
+
+// detachSession is called when c no longer serves s.
+func (srv *Server) detachSession(s *session, c *conn) {
+	s.mu.Lock()
+	if s.conn == c {
+		s.conn = nil
+	}
+	s.mu.Unlock()
+
+	srv.releaseSession(s)
+}
+
+// retainSession keeps a named session that has deliveries pending around
+// for its client to resume, even if its connection has already gone.
+func (srv *Server) retainSession(s *session) {
+	if !s.named {
+		return
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.sessions[s.id] == nil {
+		srv.sessions[s.id] = s
+	}
+}
+
+// releaseSession forgets a named session once its client is gone and nothing
+// is left to retransmit.
+func (srv *Server) releaseSession(s *session) {
+	if !s.named {
+		return
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil && len(s.deliveries) == 0 && srv.sessions[s.id] == s {
+		delete(srv.sessions, s.id)
+	}
+}
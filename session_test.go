@@ -0,0 +1,159 @@
+package teaspoon
+
+import (
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSessionRetransmit(t *testing.T) {
+	echo := HandlerFunc(func(w ResponseWriter, r *Request) { w.Write(r.Payload) })
+
+	Convey("An unacknowledged push should be retransmitted when the client resumes its session", t, func() {
+		server := &Server{Handler: echo, AckTimeout: time.Second}
+		id := NewSessionID()
+
+		clientConn, serverConn := net.Pipe()
+		c := newConn(serverConn, server)
+		go c.serve(context.Background())
+
+		announce := &Request{OpCode: OPCODE_SESSION, RequestID: NewRequestID(), Payload: id[:]}
+		announce.WriteTo(clientConn)
+
+		// The reply proves the session frame has been processed.
+		(&Request{OpCode: OPCODE_BINARY, RequestID: NewRequestID()}).WriteTo(clientConn)
+		_, err := ReadRequest(clientConn)
+		So(err, ShouldBeNil)
+
+		req := &Request{OpCode: OPCODE_BINARY, RequestID: NewRequestID(), Payload: []byte("NEWS")}
+		pushed := make(chan error, 1)
+		go func() {
+			pushed <- c.Push(context.Background(), req, WithAck())
+		}()
+
+		// Receive the push but drop the connection without acknowledging it.
+		received, err := ReadRequest(clientConn)
+		So(err, ShouldBeNil)
+		So(received.RequestID, ShouldResemble, req.RequestID)
+
+		clientConn.Close()
+		<-c.done
+
+		pushes := make(chan *Request, 2)
+		clientConn, serverConn = net.Pipe()
+		go newConn(serverConn, server).serve(context.Background())
+		second := NewClient(clientConn, WithSession(id), WithPushHandler(func(r *Request) { pushes <- r }))
+		defer second.Close()
+
+		So(<-pushed, ShouldBeNil)
+
+		push := <-pushes
+		So(push.RequestID, ShouldResemble, req.RequestID)
+		So(push.Payload, ShouldResemble, []byte("NEWS"))
+	})
+
+	Convey("A push that is never acknowledged should fail after the ack timeout", t, func() {
+		errs := make(chan error, 1)
+		server := &Server{
+			Handler:    echo,
+			AckTimeout: time.Millisecond * 20,
+			ErrorHook:  func(c io.Writer, err error) { errs <- err },
+		}
+
+		clientConn, serverConn := net.Pipe()
+		c := newConn(serverConn, server)
+		go c.serve(context.Background())
+		client := NewClient(clientConn, WithSession(NewSessionID()))
+		defer client.Close()
+
+		req := &Request{OpCode: OPCODE_BINARY, RequestID: NewRequestID()}
+		err := c.Push(context.Background(), req, WithAck())
+		So(err, ShouldResemble, &AckTimeoutError{RequestID: req.RequestID})
+		So(<-errs, ShouldResemble, err)
+	})
+
+	Convey("A push on a connection without a session should fail when it closes", t, func() {
+		server := &Server{Handler: echo, AckTimeout: time.Second}
+
+		clientConn, serverConn := net.Pipe()
+		c := newConn(serverConn, server)
+		go c.serve(context.Background())
+		client := NewClient(clientConn)
+
+		pushed := make(chan error, 1)
+		go func() {
+			pushed <- c.Push(context.Background(), &Request{OpCode: OPCODE_BINARY}, WithAck())
+		}()
+
+		client.Close()
+		So(<-pushed, ShouldEqual, ConnClosed)
+	})
+
+	Convey("A push should be forgotten by the session the client announced while it was waiting", t, func() {
+		server := &Server{Handler: echo, AckTimeout: time.Second}
+		id := NewSessionID()
+
+		clientConn, serverConn := net.Pipe()
+		c := newConn(serverConn, server)
+		go c.serve(context.Background())
+		defer clientConn.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		req := &Request{OpCode: OPCODE_BINARY, RequestID: NewRequestID()}
+		pushed := make(chan error, 1)
+		go func() {
+			pushed <- c.Push(ctx, req, WithAck())
+		}()
+
+		received, err := ReadRequest(clientConn)
+		So(err, ShouldBeNil)
+		So(received.RequestID, ShouldResemble, req.RequestID)
+
+		(&Request{OpCode: OPCODE_SESSION, RequestID: NewRequestID(), Payload: id[:]}).WriteTo(clientConn)
+
+		// The reply proves the session frame has been processed; the push is
+		// retransmitted to the session before it.
+		marker := &Request{OpCode: OPCODE_BINARY, RequestID: NewRequestID()}
+		marker.WriteTo(clientConn)
+		for received.RequestID != marker.RequestID {
+			received, err = ReadRequest(clientConn)
+			So(err, ShouldBeNil)
+		}
+
+		cancel()
+		So(<-pushed, ShouldEqual, context.Canceled)
+
+		server.mu.Lock()
+		s := server.sessions[id]
+		server.mu.Unlock()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		So(len(s.deliveries), ShouldEqual, 0)
+	})
+
+	Convey("A session should be forgotten once nothing is left to retransmit", t, func() {
+		server := &Server{Handler: echo}
+
+		clientConn, serverConn := net.Pipe()
+		c := newConn(serverConn, server)
+		go c.serve(context.Background())
+		client := NewClient(clientConn, WithSession(NewSessionID()))
+
+		_, err := client.Do(context.Background(), &Request{OpCode: OPCODE_BINARY})
+		So(err, ShouldBeNil)
+		So(len(server.sessions), ShouldEqual, 1)
+
+		client.Close()
+		<-c.done
+
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		So(len(server.sessions), ShouldEqual, 0)
+	})
+}
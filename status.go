@@ -0,0 +1,38 @@
+package teaspoon
+
+import (
+	"fmt"
+)
+
+const (
+	STATUS_BAD_REQUEST        = 400
+	STATUS_NOT_FOUND          = 404
+	STATUS_METHOD_NOT_ALLOWED = 405
+	STATUS_INTERNAL_ERROR     = 500
+	STATUS_UNAVAILABLE        = 503
+)
+
+// ReplyError is returned for calls the server answered with an error reply.
+type ReplyError struct {
+	Code    int
+	Message string
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("The server replied with status %d: %s", e.Code, e.Message)
+}
+
+func statusPayload(code int, message string) []byte {
+	return append([]byte{byte(code >> 8), byte(code)}, message...)
+}
+
+func parseReplyError(r *Request) *ReplyError {
+	if len(r.Payload) < 2 {
+		return &ReplyError{Code: STATUS_INTERNAL_ERROR}
+	}
+
+	return &ReplyError{
+		Code:    (int(r.Payload[0]) << 8) + int(r.Payload[1]),
+		Message: string(r.Payload[2:]),
+	}
+}